@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
 	"sync"
 	"unsafe"
 )
@@ -50,6 +51,61 @@ func ParseID(s string) (ID, error) {
 	return ID(i), nil
 }
 
+// ParseTraceparent parses the given W3C Trace Context traceparent header(eg.
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"), see
+// https://www.w3.org/TR/trace-context/#traceparent-header. The returned SpanID
+// is the one of the remote span(the header's parent ID), so spans handling the
+// request should be created with NewSpanID.
+//
+// As ID is a 64-bit value, the 128-bit trace ID is mapped to it's low 64 bits
+// (the last 16 hex digits), like ImportZipkin does, so the same trace ID always
+// maps to the same ID; the high 64 bits may be collected with the
+// TraceIDHighAnnotationKey annotation. The trace flags are validated but
+// otherwise ignored.
+func ParseTraceparent(header string) (SpanID, error) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 {
+		return SpanID{}, fmt.Errorf("invalid traceparent %q", header)
+	}
+	version, err := strconv.ParseUint(parts[0], 16, 8)
+	if err != nil || !isLowerHex(parts[0]) || version == 0xff {
+		return SpanID{}, fmt.Errorf("invalid traceparent version %q", parts[0])
+	}
+	// Later versions may append fields, which are ignored.
+	if version == 0 && len(parts) != 4 {
+		return SpanID{}, fmt.Errorf("invalid traceparent %q", header)
+	}
+	traceID, spanID, flags := parts[1], parts[2], parts[3]
+	if len(traceID) != 32 || !isLowerHex(traceID) || strings.Trim(traceID, "0") == "" {
+		return SpanID{}, fmt.Errorf("invalid traceparent trace ID %q", traceID)
+	}
+	if len(spanID) != 16 || !isLowerHex(spanID) || strings.Trim(spanID, "0") == "" {
+		return SpanID{}, fmt.Errorf("invalid traceparent parent ID %q", spanID)
+	}
+	if len(flags) != 2 || !isLowerHex(flags) {
+		return SpanID{}, fmt.Errorf("invalid traceparent flags %q", flags)
+	}
+	trace, err := ParseID(traceID[16:])
+	if err != nil {
+		return SpanID{}, err
+	}
+	span, err := ParseID(spanID)
+	if err != nil {
+		return SpanID{}, err
+	}
+	return SpanID{Trace: trace, Span: span}, nil
+}
+
+// isLowerHex reports whether s only has lowercase hexadecimal digits.
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
 // generateID returns a randomly-generated 64-bit ID. This function is
 // thread-safe.  IDs are produced by consuming an AES-CTR-128 keystream in
 // 64-bit chunks. The AES key is randomly generated on initialization, as is the
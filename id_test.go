@@ -90,6 +90,44 @@ func TestParseIDError(t *testing.T) {
 	}
 }
 
+func TestParseTraceparent(t *testing.T) {
+	got, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SpanID{Trace: 0xa3ce929d0e0e4736, Span: 0x00f067aa0ba902b7}
+	if got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Later versions may have more fields.
+	got, err = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-future")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestParseTraceparentError(t *testing.T) {
+	for _, header := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1",
+	} {
+		if id, err := ParseTraceparent(header); err == nil {
+			t.Errorf("%q: unexpectedly parsed value: %v", header, id)
+		}
+	}
+}
+
 func BenchmarkIDGeneration(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		generateID()
@@ -0,0 +1,176 @@
+package appdash
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// nameAnnotationKey is the key of the span name annotation(see Span.Name).
+const nameAnnotationKey = "Name"
+
+// AggregatedResult contains the number of spans with the same name & their latency percentiles.
+type AggregatedResult struct {
+	Name          string        // Span name.
+	Count         int64         // Number of spans(with a duration) named `Name`.
+	P50, P90, P99 time.Duration // Latency percentiles.
+}
+
+// LatencyStat contains the number of spans with the same name & their latency percentiles, see LatencyStats.
+type LatencyStat struct {
+	Count         int64         // Number of spans(with a duration).
+	P50, P95, P99 time.Duration // Latency percentiles.
+}
+
+// Aggregate rolls up the spans collected between `start` & `end` ago(eg. Aggregate(time.Hour, 0) for
+// the last hour) by span name, returning the results sorted by name. Only spans with a name & a
+// duration(see SlowestSpans) are aggregated.
+//
+// The aggregation is performed over the queried span names & durations, not by InfluxDB: they may be
+// collected by separate Collect calls(eg. by a Recorder), so the span's points are merged first.
+func (in *InfluxDBStore) Aggregate(start, end time.Duration) ([]*AggregatedResult, error) {
+	if start < end {
+		return nil, fmt.Errorf("appdash influxdb: invalid aggregation window, start(%s) must be before end(%s)", start, end)
+	}
+	where := fmt.Sprintf("time >= now() - %du AND time <= now() - %du", start/time.Microsecond, end/time.Microsecond)
+	byName, err := in.aggregate(where, []int{50, 90, 99})
+	if err != nil {
+		return nil, fmt.Errorf("appdash influxdb: aggregating spans: %w", err)
+	}
+	results := make([]*AggregatedResult, 0, len(byName))
+	for name, l := range byName {
+		results = append(results, &AggregatedResult{
+			Name:  name,
+			Count: l.count,
+			P50:   l.percentiles[0],
+			P90:   l.percentiles[1],
+			P99:   l.percentiles[2],
+		})
+	}
+	sort.Sort(aggregatedResultsByName(results))
+	return results, nil
+}
+
+// LatencyStats is like Aggregate, but rolls up the spans collected between the `start` & `end`
+// times(inclusive) returning the p50, p95 & p99 latencies by span name. Span names without
+// any duration are left out.
+func (in *InfluxDBStore) LatencyStats(start, end time.Time) (map[string]LatencyStat, error) {
+	if end.Before(start) {
+		return nil, fmt.Errorf("appdash influxdb: invalid latency stats window, start(%s) must be before end(%s)", start, end)
+	}
+	where := fmt.Sprintf("time >= '%s' AND time <= '%s'", start.UTC().Format(time.RFC3339Nano), end.UTC().Format(time.RFC3339Nano))
+	byName, err := in.aggregate(where, []int{50, 95, 99})
+	if err != nil {
+		return nil, fmt.Errorf("appdash influxdb: computing latency stats: %w", err)
+	}
+	stats := make(map[string]LatencyStat, len(byName))
+	for name, l := range byName {
+		stats[name] = LatencyStat{
+			Count: l.count,
+			P50:   l.percentiles[0],
+			P95:   l.percentiles[1],
+			P99:   l.percentiles[2],
+		}
+	}
+	return stats, nil
+}
+
+// latencies are the number of spans with the same name & their latency percentiles, see aggregate.
+type latencies struct {
+	count       int64
+	percentiles []time.Duration // In the order requested.
+}
+
+// aggregate returns the latencies(the `ps` percentiles) by span name of the spans matched by `where`,
+// see Aggregate.
+func (in *InfluxDBStore) aggregate(where string, ps []int) (map[string]*latencies, error) {
+	// The name & duration of a span may be on different points, so the span's points are merged. Every
+	// point has the schemas field, so the points of an indexed name(ie. a tag) are queried too.
+	q := fmt.Sprintf("SELECT %s, %s, %s FROM %s WHERE %s GROUP BY *", quoteIdent(nameAnnotationKey), durationFieldName, schemasFieldName, quoteIdent(in.measurement), where)
+	result, err := in.executeOneQuery(context.Background(), q)
+	if err != nil {
+		return nil, err
+	}
+	if result.Series, err = mergeSeries(result.Series); err != nil {
+		return nil, err
+	}
+	durations := make(map[string][]time.Duration)
+	for _, s := range result.Series {
+		nameIdx, durationIdx := -1, -1
+		for i, column := range s.Columns {
+			switch column {
+			case nameAnnotationKey:
+				nameIdx = i
+			case durationFieldName:
+				durationIdx = i
+			}
+		}
+		if durationIdx == -1 {
+			continue
+		}
+		for _, row := range s.Values {
+			v := s.Tags[nameAnnotationKey] // Set if the name is indexed.
+			if nameIdx != -1 {
+				if field, ok := row[nameIdx].(string); ok && field != "" {
+					v = field
+				}
+			}
+			if v == "" || row[durationIdx] == nil { // Spans without name or duration.
+				continue
+			}
+			name := string(decodeAnnotationValue(v))
+			d, err := numberValue(row[durationIdx])
+			if err != nil {
+				return nil, err
+			}
+			durations[name] = append(durations[name], time.Duration(d))
+		}
+	}
+	byName := make(map[string]*latencies, len(durations))
+	for name, ds := range durations {
+		sort.Sort(durationsAsc(ds))
+		l := &latencies{count: int64(len(ds))}
+		for _, p := range ps {
+			l.percentiles = append(l.percentiles, percentile(ds, p))
+		}
+		byName[name] = l
+	}
+	return byName, nil
+}
+
+// percentile returns the nearest-rank `p`th percentile of `ds`(sorted ascending), as
+// InfluxDB's percentile function does.
+func percentile(ds []time.Duration, p int) time.Duration {
+	if len(ds) == 0 {
+		return 0
+	}
+	i := int(float64(len(ds))*float64(p)/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	return ds[i]
+}
+
+// numberValue returns `v`, a number decoded from a query response, as float64.
+func numberValue(v interface{}) (float64, error) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("unexpected number type: %v", reflect.TypeOf(v))
+	}
+	return n.Float64()
+}
+
+type aggregatedResultsByName []*AggregatedResult
+
+func (a aggregatedResultsByName) Len() int           { return len(a) }
+func (a aggregatedResultsByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a aggregatedResultsByName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+
+type durationsAsc []time.Duration
+
+func (d durationsAsc) Len() int           { return len(d) }
+func (d durationsAsc) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d durationsAsc) Less(i, j int) bool { return d[i] < d[j] }
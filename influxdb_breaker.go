@@ -0,0 +1,81 @@
+package appdash
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// defaultCircuitBreakerCooldown is how long the circuit breaker stays open when
+// InfluxDBStoreConfig.CircuitBreakerCooldown is unset.
+const defaultCircuitBreakerCooldown = 30 * time.Second
+
+// circuitBreaker fast-fails writes with ErrCircuitOpen while InfluxDB is down, so the instrumented
+// application doesn't wait on each one(see InfluxDBStoreConfig.CircuitBreakerThreshold). It opens
+// after `threshold` consecutive transient failures(see isRetryable), then once `cooldown` elapses
+// it half-opens: a single write probes whether InfluxDB recovered, closing it on success or
+// opening it again on failure. A nil *circuitBreaker never fails writes.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int           // Consecutive failures opening the breaker.
+	cooldown  time.Duration // How long the breaker stays open before half-opening.
+	failures  int           // Consecutive failures.
+	openedAt  time.Time     // Time the breaker opened, zero if closed.
+	probing   bool          // Whether a half-open probe is in flight.
+}
+
+// newCircuitBreaker returns a breaker opening after `threshold` consecutive failures for `cooldown`
+// (defaultCircuitBreakerCooldown if not positive), nil if `threshold` isn't positive.
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	if cooldown <= 0 {
+		cooldown = defaultCircuitBreakerCooldown
+	}
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow returns ErrCircuitOpen if a write can't be performed at `now`, otherwise the write must
+// be performed & it's result reported through done.
+func (b *circuitBreaker) allow(now time.Time) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.openedAt.IsZero(): // Closed.
+		return nil
+	case now.Sub(b.openedAt) < b.cooldown, b.probing:
+		return ErrCircuitOpen
+	}
+	b.probing = true // Half-open, this write is the probe.
+	return nil
+}
+
+// done reports the result of a write allowed at `now`, see allow.
+func (b *circuitBreaker) done(now time.Time, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	probe := b.probing
+	b.probing = false
+	cancelled := errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+	switch {
+	case err == nil, !cancelled && !isRetryable(err):
+		// InfluxDB responded, even if the write was rejected(eg. an invalid point).
+		b.failures = 0
+		b.openedAt = time.Time{}
+	case cancelled:
+		// The caller gave up, which says nothing about InfluxDB: a half-open breaker probes again.
+	default:
+		b.failures++
+		if probe || b.failures >= b.threshold {
+			b.openedAt = now
+		}
+	}
+}
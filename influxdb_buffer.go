@@ -0,0 +1,241 @@
+package appdash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	influxDBClient "github.com/influxdata/influxdb/client"
+)
+
+// Flush writes all the collected spans pending to be written(see InfluxDBStoreConfig.BatchSize), blocking until
+// the write completes. Once it returns without error, all the spans collected before calling it are queryable.
+func (in *InfluxDBStore) Flush() error {
+	return in.flushBuffer(context.Background())
+}
+
+// BufferFullPolicy is how Collect & CollectBatch behave once the write buffer is full, see
+// InfluxDBStoreConfig.MaxBufferedPoints.
+type BufferFullPolicy int
+
+const (
+	// BufferFullBlock makes Collect wait until the buffer has room(default): buffered points are
+	// flushed, retrying every bufferFullRetryInterval until written or the collect's context is done.
+	BufferFullBlock BufferFullPolicy = iota
+
+	// BufferFullDropNewest drops the collected points which don't fit on the buffer.
+	BufferFullDropNewest
+
+	// BufferFullDropOldest drops the oldest buffered points to make room for the collected ones.
+	BufferFullDropOldest
+)
+
+// String returns the name of `p`, eg. "Block".
+func (p BufferFullPolicy) String() string {
+	switch p {
+	case BufferFullBlock:
+		return "Block"
+	case BufferFullDropNewest:
+		return "DropNewest"
+	case BufferFullDropOldest:
+		return "DropOldest"
+	default:
+		return fmt.Sprintf("BufferFullPolicy(%d)", int(p))
+	}
+}
+
+// bufferFullRetryInterval is the wait between the flushes of a full buffer, see BufferFullBlock.
+const bufferFullRetryInterval = 100 * time.Millisecond
+
+// errPointDropped is returned by bufferPoint when the point is dropped, see BufferFullDropNewest.
+var errPointDropped = errors.New("write buffer full, point dropped")
+
+// bufferedKey is a span on the write buffer, see dropOldestPoint.
+type bufferedKey struct {
+	key  spanKey
+	time time.Time // Time of the span's buffered point, which is kept when merged.
+}
+
+// writeErrorsSize is the number of background write failures kept until received, see WriteErrors.
+const writeErrorsSize = 100
+
+// WriteErrors returns a channel receiving the failures of the writes performed in the background, ie.
+// the periodic flushes of buffered spans(see InfluxDBStoreConfig.FlushInterval), so they can be logged
+// or alerted on. Failed spans are kept buffered & written on the next flush. The failures of writes
+// performed by Collect, CollectBatch, Flush or Close are returned by them instead.
+//
+// Up to writeErrorsSize failures are kept until received, later ones are dropped so the writer never
+// blocks. The channel is closed by Close.
+func (in *InfluxDBStore) WriteErrors() <-chan error {
+	return in.writeErrors
+}
+
+// reportWriteError sends `err`(a background write failure) to the WriteErrors channel, unless it's full.
+func (in *InfluxDBStore) reportWriteError(err error) {
+	select {
+	case in.writeErrors <- err:
+	default:
+	}
+}
+
+// buffering reports whether write buffering is enabled.
+func (in *InfluxDBStore) buffering() bool {
+	return in.batchSize > 0 || in.flushInterval > 0
+}
+
+// bufferPoint adds the span's point `p` to the write buffer, merging it with the span's point
+// already buffered(if any). The buffer is flushed once it contains `in.batchSize` points. Once
+// it contains `in.maxBufferedPoints` points, `in.bufferFullPolicy` is applied for new spans.
+func (in *InfluxDBStore) bufferPoint(ctx context.Context, id SpanID, p *influxDBClient.Point) error {
+	hi, err := tagsTraceIDHigh(p.Tags, in.idEncoding)
+	if err != nil {
+		return err
+	}
+	key := spanKey{hi: hi, id: id}
+	in.bufferMu.Lock()
+	if in.buffer == nil {
+		in.buffer = make(map[spanKey]*influxDBClient.Point)
+	}
+	old, found := in.buffer[key]
+	for !found && in.maxBufferedPoints > 0 && len(in.buffer) >= in.maxBufferedPoints {
+		switch in.bufferFullPolicy {
+		case BufferFullDropNewest:
+			in.bufferMu.Unlock()
+			in.stats.observeDropped(1)
+			return errPointDropped
+		case BufferFullDropOldest:
+			in.dropOldestPoint()
+		default:
+			in.bufferMu.Unlock()
+			if err := in.flushBuffer(ctx); err != nil {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(bufferFullRetryInterval):
+				}
+			}
+			in.bufferMu.Lock()
+			old, found = in.buffer[key]
+		}
+	}
+	if found {
+		// The buffered point was not written yet, so it's tags & fields must be kept. As when
+		// merging the span's points on read(see mergeSeries), non-empty fields are never replaced
+		// but the last updated time.
+		lastUpdated := p.Fields[lastUpdatedFieldName]
+		for k, v := range old.Tags {
+			if _, present := p.Tags[k]; !present {
+				p.Tags[k] = v
+			}
+		}
+		for k, v := range old.Fields {
+			if _, present := p.Fields[k]; present && (v == nil || v == "") {
+				continue
+			}
+			p.Fields[k] = v
+		}
+		schemas, err := mergeSchemasField(p.Fields[schemasFieldName], old.Fields[schemasFieldName])
+		if err != nil {
+			in.bufferMu.Unlock()
+			return err
+		}
+		p.Fields[schemasFieldName] = schemas
+		p.Fields[lastUpdatedFieldName] = lastUpdated
+		p.Time = old.Time
+	}
+	if !found && in.bufferFullPolicy == BufferFullDropOldest && in.maxBufferedPoints > 0 {
+		in.bufferOrder = append(in.bufferOrder, bufferedKey{key: key, time: p.Time})
+	}
+	in.buffer[key] = p
+	full := in.batchSize > 0 && len(in.buffer) >= in.batchSize
+	in.bufferMu.Unlock()
+	if full {
+		return in.flushBuffer(ctx)
+	}
+	return nil
+}
+
+// flushBuffer writes all the buffered points within a single request. If the write fails,
+// points are kept on the buffer to be written on the next flush.
+func (in *InfluxDBStore) flushBuffer(ctx context.Context) error {
+	in.bufferMu.Lock()
+	if len(in.buffer) == 0 {
+		in.bufferMu.Unlock()
+		return nil
+	}
+	pending := make(map[spanKey]*influxDBClient.Point, len(in.buffer))
+	pts := make([]influxDBClient.Point, 0, len(in.buffer))
+	for key, p := range in.buffer {
+		pending[key] = p
+		pts = append(pts, *p)
+	}
+	in.bufferMu.Unlock()
+
+	if err := in.writePoints(ctx, pts); err != nil {
+		return err
+	}
+
+	// Removes written points from the buffer, except those updated(by Collect) meanwhile.
+	in.bufferMu.Lock()
+	for key, p := range pending {
+		if in.buffer[key] == p {
+			delete(in.buffer, key)
+		}
+	}
+	if len(in.bufferOrder) > 2*len(in.buffer) { // Mostly written spans, see dropOldestPoint.
+		order := in.bufferOrder[:0]
+		for _, b := range in.bufferOrder {
+			if p, found := in.buffer[b.key]; found && p.Time.Equal(b.time) {
+				order = append(order, b)
+			}
+		}
+		in.bufferOrder = order
+	}
+	in.bufferMu.Unlock()
+	return nil
+}
+
+// dropOldestPoint drops the oldest point of the write buffer, `in.bufferMu` must be held.
+//
+// Buffered spans are kept in order on `in.bufferOrder`, which isn't updated when they're written(see
+// flushBuffer) so it may have stale entries: spans no longer buffered, or buffered again since.
+func (in *InfluxDBStore) dropOldestPoint() {
+	for len(in.bufferOrder) > 0 {
+		b := in.bufferOrder[0]
+		in.bufferOrder = in.bufferOrder[1:]
+		if p, found := in.buffer[b.key]; found && p.Time.Equal(b.time) {
+			delete(in.buffer, b.key)
+			in.stats.observeDropped(1)
+
+			// The dropped point may merge re-collected spans, which must be written once collected again.
+			in.collected.purge()
+			return
+		}
+	}
+}
+
+// startFlushing starts flushing the write buffer every `in.flushInterval`, if set.
+func (in *InfluxDBStore) startFlushing() {
+	if in.flushInterval <= 0 {
+		return
+	}
+	in.flushStop = make(chan struct{})
+	in.flushDone = make(chan struct{})
+	go func() {
+		defer close(in.flushDone)
+		ticker := time.NewTicker(in.flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// Failed writes are kept on the buffer and retried on the next flush.
+				if err := in.flushBuffer(context.Background()); err != nil {
+					in.reportWriteError(fmt.Errorf("appdash influxdb: flushing buffered spans: %w", err))
+				}
+			case <-in.flushStop:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,132 @@
+package appdash
+
+import (
+	"container/list"
+	"sync"
+)
+
+// traceCache is a size-bounded LRU cache of traces by ID, see InfluxDBStoreConfig.TraceCacheSize.
+// A nil *traceCache caches nothing.
+type traceCache struct {
+	mu    sync.Mutex
+	size  int                  // Maximum number of cached traces.
+	order *list.List           // Cached traces, most recently used first; values are *traceCacheEntry.
+	items map[ID]*list.Element // Elements of `order` by trace ID.
+	gen   uint64               // Incremented on every invalidation, see add.
+}
+
+type traceCacheEntry struct {
+	id    ID
+	trace *Trace
+}
+
+// newTraceCache returns a cache of up to `size` traces, nil if `size` isn't positive.
+func newTraceCache(size int) *traceCache {
+	if size <= 0 {
+		return nil
+	}
+	return &traceCache{
+		size:  size,
+		order: list.New(),
+		items: make(map[ID]*list.Element, size),
+	}
+}
+
+// generation returns the current generation of the cache, to be passed to add.
+func (c *traceCache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// get returns a copy of the cached trace `id`, if any.
+func (c *traceCache) get(id ID) (*Trace, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[id]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return copyTrace(e.Value.(*traceCacheEntry).trace), true
+}
+
+// add caches a copy of `t` as the trace `id`, evicting the least recently used trace if the cache
+// is full. It's a no-op if the cache was invalidated since `gen`, since `t` may have been queried
+// before a write which changed it.
+func (c *traceCache) add(id ID, t *Trace, gen uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if e, ok := c.items[id]; ok {
+		e.Value.(*traceCacheEntry).trace = copyTrace(t)
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[id] = c.order.PushFront(&traceCacheEntry{id: id, trace: copyTrace(t)})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*traceCacheEntry).id)
+	}
+}
+
+// remove invalidates the cached traces `ids`.
+func (c *traceCache) remove(ids ...ID) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for _, id := range ids {
+		if e, ok := c.items[id]; ok {
+			c.order.Remove(e)
+			delete(c.items, id)
+		}
+	}
+}
+
+// purge invalidates all the cached traces.
+func (c *traceCache) purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.order.Init()
+	c.items = make(map[ID]*list.Element, c.size)
+}
+
+// copyTrace returns a deep copy of `t`, so cached traces are never modified by callers(eg. by pruneTrace).
+func copyTrace(t *Trace) *Trace {
+	cp := *t
+	cp.Annotations = append(Annotations(nil), t.Annotations...)
+	cp.Sub = copyTraces(t.Sub)
+	cp.UnattachedSpans = copyTraces(t.UnattachedSpans)
+	return &cp
+}
+
+// copyTraces returns deep copies of `traces`, see copyTrace.
+func copyTraces(traces []*Trace) []*Trace {
+	if traces == nil {
+		return nil
+	}
+	cp := make([]*Trace, len(traces))
+	for i, t := range traces {
+		cp[i] = copyTrace(t)
+	}
+	return cp
+}
@@ -0,0 +1,114 @@
+package appdash
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// defaultCleanupInterval is the interval between retention cleanups when InfluxDBStoreConfig.CleanupInterval is unset.
+const defaultCleanupInterval = time.Minute
+
+// cleanup deletes the traces whose newest span point is older than `in.maxAge`, then calls
+// `in.onTraceExpired`(if set) for each one of them.
+//
+// Whole traces are deleted(see deleteTraces), as a span is made of several points(see spanPoint) &
+// deleting only the older ones would change it's time & annotations, leaving partial traces. Which
+// is also why "DELETE FROM ... WHERE time < ..." isn't used, besides InfluxDB 0.11 not supporting it.
+func (in *InfluxDBStore) cleanup(ctx context.Context) error {
+	start := time.Now()
+	cutoff := start.Add(-in.maxAge).UTC().Format(time.RFC3339Nano)
+	expired, err := in.traceIDsWhere(ctx, fmt.Sprintf("time < '%s'", cutoff))
+	if err == nil && len(expired) > 0 {
+		// Traces with newer points are left out.
+		var live []ID
+		live, err = in.traceIDsWhere(ctx, fmt.Sprintf("time >= '%s' AND %s", cutoff, in.traceIDsCondition(expired)))
+		expired = removeIDs(expired, live)
+	}
+	if err == nil {
+		err = in.deleteTraces(ctx, expired)
+	}
+	if err != nil {
+		in.log().Printf("appdash influxdb: retention cleanup of traces older than %s: %v", in.maxAge, err)
+		return err
+	}
+	in.log().Debugf("appdash influxdb: retention cleanup of %d traces older than %s done in %s", len(expired), in.maxAge, time.Since(start))
+	if in.onTraceExpired != nil {
+		for _, id := range expired {
+			in.onTraceExpired(id)
+		}
+	}
+	return nil
+}
+
+// removeIDs returns the IDs on `ids` which aren't on `remove`, keeping their order.
+func removeIDs(ids, remove []ID) []ID {
+	removed := make(map[ID]struct{}, len(remove))
+	for _, id := range remove {
+		removed[id] = struct{}{}
+	}
+	kept := ids[:0]
+	for _, id := range ids {
+		if _, ok := removed[id]; !ok {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
+
+// traceIDsWhere returns the IDs of the traces with spans matched by `condition`(the "where" part of
+// the query), sorted.
+func (in *InfluxDBStore) traceIDsWhere(ctx context.Context, condition string) ([]ID, error) {
+	q := fmt.Sprintf("SELECT count(%s) FROM %s WHERE %s GROUP BY trace_id", schemasFieldName, quoteIdent(in.measurement), condition)
+	result, err := in.executeOneStatement(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]ID, 0, len(result.Series))
+	for _, s := range result.Series {
+		id, err := in.idEncoding.parse(s.Tags["trace_id"])
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	sort.Sort(byID(ids))
+	return ids, nil
+}
+
+// startCleanup starts deleting spans older than `in.maxAge` every `in.cleanupInterval`, if `in.maxAge` is set.
+func (in *InfluxDBStore) startCleanup() {
+	if in.maxAge <= 0 {
+		return
+	}
+	interval := in.cleanupInterval
+	if interval <= 0 {
+		interval = defaultCleanupInterval
+	}
+	in.cleanupStop = make(chan struct{})
+	in.cleanupDone = make(chan struct{})
+	go func() {
+		defer close(in.cleanupDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// Failed cleanups are retried on the next tick.
+				in.cleanup(context.Background())
+			case <-in.cleanupStop:
+				return
+			}
+		}
+	}()
+}
+
+// stopCleanup stops the retention cleanups started by startCleanup, waiting for a cleanup in progress to finish.
+func (in *InfluxDBStore) stopCleanup() {
+	if in.cleanupStop == nil {
+		return
+	}
+	close(in.cleanupStop)
+	<-in.cleanupDone
+}
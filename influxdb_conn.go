@@ -0,0 +1,337 @@
+package appdash
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	influxDBClient "github.com/influxdata/influxdb/client"
+	influxDBModels "github.com/influxdata/influxdb/models"
+)
+
+const (
+	defaultConnectTimeout = 5 * time.Second  // Used when influxDBConnConfig.ConnectTimeout is unset.
+	defaultWriteTimeout   = 10 * time.Second // Used when influxDBConnConfig.WriteTimeout is unset.
+)
+
+// influxDBConn is a connection to the InfluxDB HTTP API.
+//
+// It mirrors the subset of influxDBClient.Client used by InfluxDBStore, with the
+// difference that every request is bound to a context.Context, so it's aborted
+// as soon as the context is cancelled or its deadline passes.
+type influxDBConn struct {
+	url      url.URL
+	username string
+	password string
+	token    string
+	org      string
+	client   *http.Client
+
+	writeTimeout time.Duration // How long a write request may take.
+
+	// reader is the connection used for read-only queries(with the query user credentials), if nil
+	// this connection is used, see readConn.
+	reader *influxDBConn
+}
+
+// influxDBConnConfig contains the settings of an influxDBConn.
+type influxDBConnConfig struct {
+	URL       url.URL
+	Username  string
+	Password  string
+	TLSConfig *tls.Config // TLS settings used for "https" URLs, if nil the default settings are used.
+
+	// Token & Org are used to connect to InfluxDB 2.x: requests are authenticated with the token instead
+	// of username & password, and points are written to the 2.x API(databases being the org's buckets).
+	Token string
+	Org   string
+
+	// ConnectTimeout is how long establishing a connection(including the TLS handshake) may take,
+	// defaultConnectTimeout if unset. WriteTimeout is how long a write request may take,
+	// defaultWriteTimeout if unset.
+	ConnectTimeout time.Duration
+	WriteTimeout   time.Duration
+}
+
+// newInfluxDBConn returns a connection to the InfluxDB HTTP API described by `c`.
+func newInfluxDBConn(c influxDBConnConfig) *influxDBConn {
+	if c.ConnectTimeout <= 0 {
+		c.ConnectTimeout = defaultConnectTimeout
+	}
+	if c.WriteTimeout <= 0 {
+		c.WriteTimeout = defaultWriteTimeout
+	}
+	return &influxDBConn{
+		url:      c.URL,
+		username: c.Username,
+		password: c.Password,
+		token:    c.Token,
+		org:      c.Org,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext:         (&net.Dialer{Timeout: c.ConnectTimeout}).DialContext,
+				TLSHandshakeTimeout: c.ConnectTimeout,
+				TLSClientConfig:     c.TLSConfig,
+			},
+		},
+		writeTimeout: c.WriteTimeout,
+	}
+}
+
+// Close closes the idle connections to the InfluxDB server, requests in flight are not aborted.
+func (c *influxDBConn) Close() {
+	c.client.CloseIdleConnections()
+	if c.reader != nil {
+		c.reader.Close()
+	}
+}
+
+// readConn returns the connection to be used for read-only queries.
+func (c *influxDBConn) readConn() *influxDBConn {
+	if c.reader != nil {
+		return c.reader
+	}
+	return c
+}
+
+// Query sends `q` to the InfluxDB server and returns it's response.
+//
+// Queries(ie. SELECT & SHOW) are sent as GET requests, statements(eg. CREATE USER) are POSTed as
+// InfluxDB expects for writes; their command is sent within the body, so it's never part of the
+// request URL(eg. the passwords of CREATE USER on errors & server access logs).
+func (c *influxDBConn) Query(ctx context.Context, q influxDBClient.Query) (*influxDBClient.Response, error) {
+	u := c.url
+	u.Path = "query"
+	values := u.Query()
+	values.Set("db", q.Database)
+	var (
+		req *http.Request
+		err error
+	)
+	if readOnlyCommand(q.Command) {
+		values.Set("q", q.Command)
+		u.RawQuery = values.Encode()
+		req, err = http.NewRequest("GET", u.String(), nil)
+	} else {
+		u.RawQuery = values.Encode()
+		body := url.Values{"q": {q.Command}}.Encode()
+		req, err = http.NewRequest("POST", u.String(), strings.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var response influxDBClient.Response
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	decErr := dec.Decode(&response)
+
+	// Ignore EOF decoding errors when the status code is not OK, the status code is reported below.
+	if decErr != nil && decErr.Error() == "EOF" && resp.StatusCode != http.StatusOK {
+		decErr = nil
+	}
+	if decErr != nil {
+		return nil, decErr
+	}
+	if resp.StatusCode != http.StatusOK {
+		// Query errors(eg. syntax errors) are reported on the response, server errors are status errors.
+		err := response.Error()
+		if err == nil {
+			return &response, &influxDBStatusError{Code: resp.StatusCode}
+		}
+		if resp.StatusCode >= 500 {
+			return &response, &influxDBStatusError{Code: resp.StatusCode, Message: err.Error()}
+		}
+	}
+	return &response, nil
+}
+
+// readOnlyCommand reports whether the InfluxQL `command` is a query(ie. SELECT or SHOW), as
+// opposed to a statement which may write. Queries writing their results(SELECT ... INTO) aren't used.
+func readOnlyCommand(command string) bool {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return false
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "SELECT", "SHOW":
+		return true
+	}
+	return false
+}
+
+// QueryFlux sends the Flux query `q` to the InfluxDB 2.x server and returns the tables of it's
+// response, see parseFluxTables.
+func (c *influxDBConn) QueryFlux(ctx context.Context, q string) ([]influxDBModels.Row, error) {
+	u := c.url
+	u.Path = "api/v2/query"
+	values := u.Query()
+	values.Set("org", c.org)
+	u.RawQuery = values.Encode()
+
+	// Annotations are required to decode the response, see parseFluxTables.
+	body, err := json.Marshal(map[string]interface{}{
+		"query":   q,
+		"type":    "flux",
+		"dialect": map[string]interface{}{"annotations": []string{"datatype", "group", "default"}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/csv")
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		var e struct {
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal(body, &e); err == nil && e.Message != "" {
+			body = []byte(e.Message)
+		}
+		return nil, &influxDBStatusError{Code: resp.StatusCode, Message: string(bytes.TrimSpace(body))}
+	}
+	return parseFluxTables(resp.Body)
+}
+
+// Write writes `bp` points to the InfluxDB server using the line protocol.
+func (c *influxDBConn) Write(ctx context.Context, bp influxDBClient.BatchPoints) error {
+	var b bytes.Buffer
+	for _, p := range bp.Points {
+		pt, err := influxDBModels.NewPoint(p.Measurement, p.Tags, p.Fields, p.Time)
+		if err != nil {
+			return err
+		}
+		b.WriteString(pt.String())
+		b.WriteByte('\n')
+	}
+
+	u := c.url
+	values := u.Query()
+	if c.token != "" {
+		u.Path = "api/v2/write"
+		values.Set("org", c.org)
+		values.Set("bucket", bp.Database)
+	} else {
+		u.Path = "write"
+		values.Set("db", bp.Database)
+		values.Set("rp", bp.RetentionPolicy)
+		values.Set("precision", bp.Precision)
+		values.Set("consistency", bp.WriteConsistency)
+	}
+	u.RawQuery = values.Encode()
+
+	req, err := http.NewRequest("POST", u.String(), &b)
+	if err != nil {
+		return err
+	}
+	writeCtx, cancel := context.WithTimeout(ctx, c.writeTimeout)
+	defer cancel()
+	resp, err := c.do(writeCtx, req)
+	if err != nil {
+		if err == context.DeadlineExceeded && ctx.Err() == nil {
+			return &writeTimeoutError{timeout: c.writeTimeout}
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return &influxDBStatusError{Code: resp.StatusCode, Message: string(bytes.TrimSpace(body))}
+	}
+	return nil
+}
+
+// Ping checks the InfluxDB server is up, returning the request round-trip time and the server version.
+func (c *influxDBConn) Ping(ctx context.Context) (time.Duration, string, error) {
+	u := c.url
+	u.Path = "ping"
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return 0, "", err
+	}
+	start := time.Now()
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	rtt := time.Since(start)
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return 0, "", &influxDBStatusError{Code: resp.StatusCode}
+	}
+	return rtt, resp.Header.Get("X-Influxdb-Version"), nil
+}
+
+// do sends `req` bound to `ctx`; if `ctx` is done before a response is received,
+// `ctx.Err()` is returned.
+func (c *influxDBConn) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", "appdash")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Token "+c.token)
+	} else if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// writeTimeoutError is returned by influxDBConn.Write when the write request takes longer than the
+// write timeout. It's a net.Error, so the write is retried(see isRetryable).
+type writeTimeoutError struct {
+	timeout time.Duration
+}
+
+func (e *writeTimeoutError) Error() string   { return fmt.Sprintf("write timed out after %s", e.timeout) }
+func (e *writeTimeoutError) Timeout() bool   { return true }
+func (e *writeTimeoutError) Temporary() bool { return true }
+
+// influxDBStatusError is returned when the InfluxDB server responds with an unexpected status code.
+type influxDBStatusError struct {
+	Code    int    // HTTP status code.
+	Message string // Response body or error message, may be empty.
+}
+
+func (e *influxDBStatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("received status code %d from server", e.Code)
+	}
+	return fmt.Sprintf("received status code %d from server: %s", e.Code, e.Message)
+}
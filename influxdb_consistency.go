@@ -0,0 +1,69 @@
+package appdash
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	influxDBClient "github.com/influxdata/influxdb/client"
+)
+
+const (
+	readYourWritesTimeout      = time.Second           // How long queries wait for the latest write, see awaitWrites.
+	readYourWritesPollInterval = 10 * time.Millisecond // Wait between checks, see awaitWrites.
+)
+
+// observeWritten records the time of the newest point of `pts`(just written), so queries wait for
+// it, see awaitWrites. It does nothing unless read-your-writes is enabled.
+func (in *InfluxDBStore) observeWritten(pts []influxDBClient.Point) {
+	if !in.readYourWrites {
+		return
+	}
+	in.watermarkMu.Lock()
+	defer in.watermarkMu.Unlock()
+	for _, p := range pts {
+		if p.Time.After(in.lastWritten) {
+			in.lastWritten = p.Time
+		}
+	}
+}
+
+// awaitWrites waits until the newest written point(see observeWritten) is queryable, by checking
+// for points at least as new every readYourWritesPollInterval. It gives up after
+// readYourWritesTimeout, or once `ctx` is done, leaving the query to see what's there. Queries of
+// tenants never wait, as only the writes to `in.dbName` are recorded(see WithTenant).
+func (in *InfluxDBStore) awaitWrites(ctx context.Context) {
+	if !in.readYourWrites || tenantFromContext(ctx) != "" {
+		return
+	}
+	in.watermarkMu.Lock()
+	target, visible := in.lastWritten, in.lastVisible
+	in.watermarkMu.Unlock()
+	if !target.After(visible) {
+		return // Already seen by a query.
+	}
+	condition := strings.TrimPrefix(timeRangeCondition(target, time.Time{}), " AND ")
+	q := fmt.Sprintf("SELECT count(%s) FROM %s WHERE %s", schemasFieldName, quoteIdent(in.measurement), condition)
+	deadline := time.Now().Add(readYourWritesTimeout)
+	for {
+		// Not executeOneQuery, which waits for the writes.
+		if result, err := in.executeOne(ctx, q, in.readQuery); err == nil && len(result.Series) > 0 {
+			break
+		}
+		if !time.Now().Before(deadline) {
+			in.log().Printf("appdash influxdb: writes up to %s not queryable after %s", target.Format(time.RFC3339Nano), readYourWritesTimeout)
+			return
+		}
+		select {
+		case <-time.After(readYourWritesPollInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+	in.watermarkMu.Lock()
+	defer in.watermarkMu.Unlock()
+	if target.After(in.lastVisible) {
+		in.lastVisible = target
+	}
+}
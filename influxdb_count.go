@@ -0,0 +1,100 @@
+package appdash
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// TimeBucket is the number of traces within a time interval, see TraceCountsOverTime.
+type TimeBucket struct {
+	Start time.Time // Start of the interval.
+	Count int64     // Number of traces.
+}
+
+// NumTraces returns the number of traces stored, ie. of distinct trace IDs(both their low & high 64
+// bits, see TraceIDHighAnnotationKey) among the root spans.
+func (in *InfluxDBStore) NumTraces() (int64, error) {
+	n, err := in.countSeries(context.Background(), fmt.Sprintf(" WHERE parent_id=%s", quoteTag(in.idEncoding.zero())), "trace_id, "+traceIDHighTag)
+	if err != nil {
+		return 0, fmt.Errorf("appdash influxdb: counting traces: %w", err)
+	}
+	return n, nil
+}
+
+// NumSpans returns the number of spans stored, ie. of distinct trace(see NumTraces) & span ID pairs.
+func (in *InfluxDBStore) NumSpans() (int64, error) {
+	n, err := in.countSeries(context.Background(), "", "trace_id, "+traceIDHighTag+", span_id")
+	if err != nil {
+		return 0, fmt.Errorf("appdash influxdb: counting spans: %w", err)
+	}
+	return n, nil
+}
+
+// countSeries returns the number of distinct `tags` values among the spans matched by `where`(eg.
+// " WHERE parent_id='0'"). Only counts are read: a single one if the server supports subqueries,
+// otherwise one per distinct value.
+func (in *InfluxDBStore) countSeries(ctx context.Context, where, tags string) (int64, error) {
+	// Every point has the schemas field, so each group counts at least one.
+	q := fmt.Sprintf("SELECT count(%s) AS n FROM %s%s GROUP BY %s", schemasFieldName, quoteIdent(in.measurement), where, tags)
+	if !in.subqueries {
+		result, err := in.executeOneQuery(ctx, q)
+		if err != nil {
+			return 0, err
+		}
+		return int64(len(result.Series)), nil
+	}
+	result, err := in.executeOneQuery(ctx, fmt.Sprintf("SELECT count(n) FROM (%s)", q))
+	if err != nil {
+		return 0, err
+	}
+	if len(result.Series) == 0 || len(result.Series[0].Values) == 0 {
+		return 0, nil // No spans.
+	}
+	values := result.Series[0].Values[0]
+	n, err := numberValue(values[len(values)-1])
+	if err != nil {
+		return 0, err
+	}
+	return int64(n), nil
+}
+
+// maxTimeBuckets is the maximum number of buckets returned by TraceCountsOverTime.
+const maxTimeBuckets = 10000
+
+// TraceCountsOverTime returns the number of traces whose root span time is between `start`(inclusive)
+// & `end`(exclusive), by `interval`: one bucket per interval, including empty ones. Buckets are
+// aligned to multiples of `interval` since the Unix epoch, as InfluxDB does. It's an error to request
+// more than 10000 buckets.
+//
+// Each trace counts once at it's root span time, ie. the time of it's first point(see rootsBetween): a
+// root span collected several times(ie. by separate Collect calls) has several points, so the root span
+// times within the time range are queried & counted here instead of by InfluxDB.
+func (in *InfluxDBStore) TraceCountsOverTime(start, end time.Time, interval time.Duration) ([]TimeBucket, error) {
+	if interval < time.Microsecond {
+		return nil, fmt.Errorf("appdash influxdb: invalid interval %s, must be at least 1us", interval)
+	}
+	if !start.Before(end) {
+		return nil, fmt.Errorf("appdash influxdb: invalid time range, start(%s) must be before end(%s)", start, end)
+	}
+	first := start.UnixNano() - start.UnixNano()%int64(interval)
+	if n := (end.UnixNano() - first + int64(interval) - 1) / int64(interval); n > maxTimeBuckets {
+		return nil, fmt.Errorf("appdash influxdb: invalid interval %s, %d buckets exceed the maximum of %d", interval, n, maxTimeBuckets)
+	}
+	roots, err := in.rootsBetween(context.Background(), start, end.Add(-time.Nanosecond))
+	if err != nil {
+		return nil, fmt.Errorf("appdash influxdb: counting traces: %w", err)
+	}
+	counts := make(map[int64]int64) // By bucket start(Unix nanoseconds).
+	for _, root := range roots {
+		ns := root.Time.UnixNano()
+		counts[ns-ns%int64(interval)]++
+	}
+
+	// Buckets are built here, so empty ones are included.
+	var buckets []TimeBucket
+	for ns := first; ns < end.UnixNano(); ns += int64(interval) {
+		buckets = append(buckets, TimeBucket{Start: time.Unix(0, ns).UTC(), Count: counts[ns]})
+	}
+	return buckets, nil
+}
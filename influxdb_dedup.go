@@ -0,0 +1,151 @@
+package appdash
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"sync"
+
+	influxDBClient "github.com/influxdata/influxdb/client"
+)
+
+// collectedPointsSize is the number of recently written points remembered, see collectedPoints.
+const collectedPointsSize = 10000
+
+// pointDigest identifies a point by it's tags & fields(but not it's time, nor the fields recording
+// it), see digestPoint.
+type pointDigest [sha256.Size]byte
+
+// collectedPoints is a size-bounded LRU set of the points recently written by Collect & CollectBatch,
+// so re-collecting a span with the exact same annotations(eg. by retrying clients) skips the write.
+// Points are only remembered once their write succeeds, until then re-collecting them waits for the
+// in-flight write(see claim), so a failed write is never reported as succeeded to a duplicate.
+//
+// Skipping such writes never changes what's read: a span's points are merged(see mergeSeries) keeping
+// the first non-empty value of each field & the union of the schemas, which an identical point written
+// later can't change. Points deleted by Delete or the retention cleanups are forgotten, but not
+// those dropped by the retention policy of the database. A nil *collectedPoints remembers nothing.
+type collectedPoints struct {
+	mu      sync.Mutex
+	size    int                           // Maximum number of remembered points.
+	order   *list.List                    // Remembered points, most recently collected first; values are pointDigest.
+	digest  map[pointDigest]*list.Element // Elements of `order` by digest.
+	writing map[pointDigest]chan struct{} // Points being written, closed once their write is done.
+}
+
+// newCollectedPoints returns a set of up to `size` points.
+func newCollectedPoints(size int) *collectedPoints {
+	return &collectedPoints{
+		size:    size,
+		order:   list.New(),
+		digest:  make(map[pointDigest]*list.Element, size),
+		writing: make(map[pointDigest]chan struct{}),
+	}
+}
+
+// claim reports whether `d` was already written, waiting for it's in-flight write if any. Otherwise
+// `d` is marked as being written, & the caller must report the outcome of it's write through done.
+// An error is returned if `ctx` is done while waiting.
+func (c *collectedPoints) claim(ctx context.Context, d pointDigest) (bool, error) {
+	for {
+		written, writing := c.tryClaim(d)
+		if writing == nil {
+			return written, nil
+		}
+		// Once done, it's either remembered or claimed again(eg. by this caller, if it's write failed).
+		select {
+		case <-writing:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
+// tryClaim is like claim, but doesn't wait for an in-flight write of `d`: it's returned instead(closed
+// once done), in which case `d` isn't claimed.
+func (c *collectedPoints) tryClaim(d pointDigest) (bool, chan struct{}) {
+	if c == nil {
+		return false, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.digest[d]; ok {
+		c.order.MoveToFront(e)
+		return true, nil
+	}
+	if writing, ok := c.writing[d]; ok {
+		return false, writing
+	}
+	c.writing[d] = make(chan struct{})
+	return false, nil
+}
+
+// done ends the write of `d` claimed by claim, remembering it if `written`.
+func (c *collectedPoints) done(d pointDigest, written bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	close(c.writing[d])
+	delete(c.writing, d)
+	if !written {
+		return
+	}
+	c.digest[d] = c.order.PushFront(d)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.digest, oldest.Value.(pointDigest))
+	}
+}
+
+// doneAll is like calling done for each of `digests`.
+func (c *collectedPoints) doneAll(digests []pointDigest, written bool) {
+	for _, d := range digests {
+		c.done(d, written)
+	}
+}
+
+// purge forgets all the points, so they're written again once re-collected(eg. after being deleted).
+func (c *collectedPoints) purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	c.digest = make(map[pointDigest]*list.Element, c.size)
+}
+
+// digestPoint returns the digest of `p`'s tags & fields, which are sorted by key. The fields recording
+// the point's time are left out, so re-collecting a span with the same annotations isn't written(nor
+// changes the span's last updated time, see Span.LastUpdated).
+func digestPoint(p *influxDBClient.Point) pointDigest {
+	h := sha256.New()
+	tags := make([]string, 0, len(p.Tags))
+	for k := range p.Tags {
+		tags = append(tags, k)
+	}
+	sort.Strings(tags)
+	for _, k := range tags {
+		fmt.Fprintf(h, "%q=%q\x00", k, p.Tags[k])
+	}
+	h.Write([]byte{0})
+	fields := make([]string, 0, len(p.Fields))
+	for k := range p.Fields {
+		if k == firstSeenFieldName || k == lastUpdatedFieldName { // The point's time, see spanPoint.
+			continue
+		}
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+	for _, k := range fields {
+		fmt.Fprintf(h, "%q=%T:%#v\x00", k, p.Fields[k], p.Fields[k])
+	}
+	var d pointDigest
+	copy(d[:], h.Sum(nil))
+	return d
+}
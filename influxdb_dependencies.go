@@ -0,0 +1,112 @@
+package appdash
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// serviceAnnotationKey is the key of the annotation naming the service a span belongs to, see DependencyGraph.
+const serviceAnnotationKey = "Service"
+
+// Dependency is a call edge between two services, see DependencyGraph.
+type Dependency struct {
+	Parent    string // Calling service.
+	Child     string // Called service.
+	CallCount int    // Number of child spans of `Child` whose parent span is of `Parent`.
+}
+
+// DependencyGraph returns the calls between services(ie. the service call graph) over the spans collected
+// between `start` & `end`(inclusive), a zero `start` or `end` means unbounded on that side. Dependencies are
+// returned sorted by parent & child service.
+//
+// The service of a span is it's "Service" annotation(which may be indexed, see
+// InfluxDBStoreConfig.IndexedAnnotations), spans without it are left out. Each span whose parent span
+// is of another service counts as a call, so spans whose parent span was collected outside of the
+// time window aren't counted, neither are the calls within a service.
+func (in *InfluxDBStore) DependencyGraph(start, end time.Time) ([]Dependency, error) {
+	// All the spans are queried at once, their parent span is looked up here.
+	q := fmt.Sprintf("SELECT * FROM %s", quoteIdent(in.measurement))
+	if condition := strings.TrimPrefix(timeRangeCondition(start, end), " AND "); condition != "" {
+		q += " WHERE " + condition
+	}
+	q += " GROUP BY *"
+	result, err := in.executeOneQuery(context.Background(), q)
+	if err != nil {
+		return nil, fmt.Errorf("appdash influxdb: querying dependency graph: %w", err)
+	}
+	if result.Series, err = mergeSeries(result.Series); err != nil {
+		return nil, fmt.Errorf("appdash influxdb: querying dependency graph: %w", err)
+	}
+
+	// A span is identified by it's trace key & span ID, as spans of different traces may share their span ID.
+	type spanRef struct {
+		trace traceKey
+		span  ID
+	}
+	type span struct {
+		ref, parent spanRef
+		service     string
+	}
+	var (
+		spans    = make([]span, 0, len(result.Series))
+		services = make(map[spanRef]string, len(result.Series))
+	)
+	for _, s := range result.Series {
+		key, err := rowTraceKey(&s, in.idEncoding)
+		if err != nil {
+			return nil, fmt.Errorf("appdash influxdb: querying dependency graph: %w", err)
+		}
+		raw, err := rawSpanFromRow(&s, in.idEncoding)
+		if err != nil {
+			return nil, fmt.Errorf("appdash influxdb: querying dependency graph: %w", err)
+		}
+		sp := span{
+			ref:    spanRef{trace: key, span: raw.ID.Span},
+			parent: spanRef{trace: key, span: raw.ID.Parent},
+		}
+		for _, a := range raw.Annotations {
+			if a.Key == serviceAnnotationKey {
+				sp.service = string(a.Value)
+				break
+			}
+		}
+		if sp.service == "" {
+			continue
+		}
+		services[sp.ref] = sp.service
+		spans = append(spans, sp)
+	}
+
+	type edge struct{ parent, child string }
+	counts := make(map[edge]int)
+	for _, sp := range spans {
+		if sp.parent.span == 0 {
+			continue // Root span.
+		}
+		parent, found := services[sp.parent]
+		if !found || parent == sp.service {
+			continue
+		}
+		counts[edge{parent: parent, child: sp.service}]++
+	}
+	deps := make([]Dependency, 0, len(counts))
+	for e, n := range counts {
+		deps = append(deps, Dependency{Parent: e.parent, Child: e.child, CallCount: n})
+	}
+	sort.Sort(dependenciesByServices(deps))
+	return deps, nil
+}
+
+type dependenciesByServices []Dependency
+
+func (d dependenciesByServices) Len() int      { return len(d) }
+func (d dependenciesByServices) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d dependenciesByServices) Less(i, j int) bool {
+	if d[i].Parent != d[j].Parent {
+		return d[i].Parent < d[j].Parent
+	}
+	return d[i].Child < d[j].Child
+}
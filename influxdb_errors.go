@@ -0,0 +1,49 @@
+package appdash
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// errorTag is the tag set to "true" on the points of erroring spans, see spanError.
+const errorTag = "error"
+
+// spanError reports whether the span annotated with `anns` errored, ie. it's annotated with:
+//   - "error" set to "true", like the OpenTracing error tag.
+//   - A non-empty "Error", eg. an error message.
+//   - A 5xx HTTP response status code(see httptrace.ClientEvent & httptrace.ServerEvent).
+func spanError(anns []Annotation) bool {
+	for _, a := range anns {
+		switch a.Key {
+		case errorTag:
+			if string(a.Value) == "true" {
+				return true
+			}
+		case "Error":
+			if len(a.Value) > 0 {
+				return true
+			}
+		case "Client.Response.StatusCode", "Server.Response.StatusCode":
+			if code, err := strconv.Atoi(string(a.Value)); err == nil && code >= 500 && code < 600 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ErrorTraces returns the traces(including all it's spans) which contain at least one erroring span
+// collected between `start` & `end`(inclusive), a zero `start` or `end` means unbounded on that side.
+// Spans are flagged as erroring by Collect, so only the erroring spans are tagged(see spanError)
+// & spans collected before it was supported are never returned.
+func (in *InfluxDBStore) ErrorTraces(start, end time.Time) ([]*Trace, error) {
+	// A span may also have an "error" field(ie. not "true"), so the tag is referred to explicitly.
+	condition := fmt.Sprintf("%s::tag=%s%s", quoteIdent(errorTag), quoteTag("true"), timeRangeCondition(start, end))
+	traces, err := in.tracesWhere(context.Background(), condition)
+	if err != nil {
+		return nil, fmt.Errorf("appdash influxdb: querying error traces: %w", err)
+	}
+	return traces, nil
+}
@@ -0,0 +1,277 @@
+package appdash
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	influxDBModels "github.com/influxdata/influxdb/models"
+)
+
+// QueryLanguage is the language used by InfluxDBStore to query traces, see InfluxDBStoreConfig.QueryLanguage.
+type QueryLanguage int
+
+const (
+	// InfluxQL queries traces using InfluxQL(default), supported by InfluxDB 1.x & by the
+	// InfluxDB 2.x compatibility API.
+	InfluxQL QueryLanguage = iota
+
+	// Flux queries traces using Flux, which requires token authentication(see
+	// InfluxDBStoreConfig.Token) to an InfluxDB 2.x server(or 1.8+ with Flux enabled).
+	Flux
+)
+
+// fluxTraceSeries is like traceSeries, but queries the spans of the trace `id` using Flux.
+func (in *InfluxDBStore) fluxTraceSeries(ctx context.Context, id ID) ([]influxDBModels.Row, error) {
+	q := fmt.Sprintf(`%s
+  |> filter(fn: (r) => r._measurement == %s and r.trace_id == %s)
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")`,
+		in.fluxFrom(time.Time{}, time.Time{}), fluxString(in.measurement), fluxString(in.idEncoding.format(id)))
+	series, err := in.executeFluxQuery(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("appdash influxdb: querying trace %s: %w", id, err)
+	}
+	return mergeSeries(series)
+}
+
+// fluxTraces is like traces(so traces are sorted the same way), but queries the traces whose root span time is within `start` &
+// `end`(a zero `start` or `end` means unbounded on that side) using Flux.
+func (in *InfluxDBStore) fluxTraces(ctx context.Context, start, end time.Time) ([]*Trace, error) {
+	traces := make([]*Trace, 0)
+
+	// Looks up the trace IDs only, the complete traces(root spans & children) are then fetched at once.
+	// Like roots, the root span points are grouped by trace to select traces by the time of their first
+	// point, only the end of the time range is applied before.
+	var startFilter string
+	if !start.IsZero() {
+		startFilter = fmt.Sprintf("\n  |> filter(fn: (r) => r._time >= %s)", start.UTC().Format(time.RFC3339Nano))
+	}
+	rootIDsQuery := fmt.Sprintf(`%s
+  |> filter(fn: (r) => r._measurement == %s and r.parent_id == %s and r._field == %s)
+  |> group(columns: ["trace_id", %s])
+  |> sort(columns: ["_time"])
+  |> first()
+  |> group()%s
+  |> sort(columns: ["_time"], desc: true)
+  |> limit(n: %d)
+  |> keep(columns: ["_time", "trace_id"])`,
+		in.fluxFrom(time.Time{}, end), fluxString(in.measurement), fluxString(in.idEncoding.zero()), fluxString(schemasFieldName),
+		fluxString(traceIDHighTag), startFilter, in.tracesPerPage)
+	rootIDsResult, err := in.executeFluxQuery(ctx, rootIDsQuery)
+	if err != nil {
+		return nil, err
+	}
+	var ids []ID
+	for _, s := range rootIDsResult {
+		traceIdx := -1
+		for i, column := range s.Columns {
+			if column == "trace_id" {
+				traceIdx = i
+			}
+		}
+		if traceIdx == -1 {
+			continue
+		}
+		for _, values := range s.Values {
+			v, ok := values[traceIdx].(string)
+			if !ok {
+				continue
+			}
+			id, err := in.idEncoding.parse(v)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return traces, nil
+	}
+
+	traceIDs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		traceIDs = append(traceIDs, fluxString(in.idEncoding.format(id)))
+	}
+	q := fmt.Sprintf(`%s
+  |> filter(fn: (r) => r._measurement == %s and contains(value: r.trace_id, set: [%s]))
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")`,
+		in.fluxFrom(time.Time{}, time.Time{}), fluxString(in.measurement), strings.Join(traceIDs, ", "))
+	series, err := in.executeFluxQuery(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if series, err = mergeSeries(series); err != nil {
+		return nil, err
+	}
+	roots, err := in.tracesFromSeries(series)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(tracesCursorsByTime(roots))
+	for _, root := range roots {
+		traces = append(traces, root.trace)
+	}
+	return traces, nil
+}
+
+// fluxFrom returns the Flux source of the spans collected between `start` & `end`(a zero `start`
+// or `end` means unbounded on that side), Flux requires a range before any other operation.
+func (in *InfluxDBStore) fluxFrom(start, end time.Time) string {
+	rng := "start: 0"
+	if !start.IsZero() {
+		rng = "start: " + start.UTC().Format(time.RFC3339Nano)
+	}
+	if !end.IsZero() {
+		// stop is exclusive, while `end` is inclusive(see timeRangeCondition).
+		rng += ", stop: " + end.Add(time.Nanosecond).UTC().Format(time.RFC3339Nano)
+	}
+	return fmt.Sprintf("from(bucket: %s)\n  |> range(%s)", fluxString(in.dbName), rng)
+}
+
+// executeFluxQuery is like executeOneQuery, but executes the Flux query `q`.
+func (in *InfluxDBStore) executeFluxQuery(ctx context.Context, q string) ([]influxDBModels.Row, error) {
+	if tenantFromContext(ctx) != "" { // Flux requires a token.
+		return nil, errTenantToken
+	}
+	start := time.Now()
+	var rows []influxDBModels.Row
+	err := in.withReconnect(ctx, func(con *influxDBConn) error {
+		var err error
+		rows, err = con.QueryFlux(ctx, q)
+		return err
+	})
+	if in.metrics != nil {
+		in.metrics.ObserveQuery(q, time.Since(start), err)
+	}
+	return rows, err
+}
+
+// fluxString returns `value` as a double-quoted Flux string literal; backslashes, double quotes &
+// interpolations("${") are escaped.
+func fluxString(value string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "${", `\${`)
+	return `"` + r.Replace(value) + `"`
+}
+
+// parseFluxTables returns the tables of `r`, a Flux response in annotated CSV(with the "datatype",
+// "group" & "default" annotations), as series similar to those returned by "GROUP BY *" InfluxQL
+// queries: the group key columns are the tags, `_measurement` the name & `_time` the "time" column.
+//
+// Flux doesn't distinguish null from empty string values on CSV, both are returned as nil.
+func parseFluxTables(r io.Reader) ([]influxDBModels.Row, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	var (
+		rows      []influxDBModels.Row
+		index     = make(map[string]int) // Table keys to `rows` index.
+		datatypes []string
+		group     []string
+		header    []string
+	)
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case record[0] == "#datatype":
+			datatypes, header = record, nil
+			continue
+		case record[0] == "#group":
+			group = record
+			continue
+		case strings.HasPrefix(record[0], "#"):
+			continue
+		case header == nil:
+			if len(datatypes) != len(record) || len(group) != len(record) {
+				return nil, errors.New("unexpected flux response without annotations")
+			}
+			header = record
+			continue
+		case len(record) != len(header):
+			return nil, errors.New("unexpected number of flux table columns")
+		}
+		if len(header) > 1 && header[1] == "error" {
+			return nil, fmt.Errorf("flux query error: %s", record[1])
+		}
+
+		// Each record is a point of the table(series) it's "table" column refers to.
+		var (
+			key    = make([]string, 0, 2)
+			tags   = make(map[string]string)
+			name   string
+			fields = make(map[string]interface{}, len(record))
+		)
+		for i, column := range header {
+			switch column {
+			case "":
+			case "result", "table":
+				key = append(key, record[i])
+			case "_start", "_stop":
+			case "_measurement":
+				name = record[i]
+			case "_time":
+				fields["time"] = record[i]
+			default:
+				if group[i] == "true" {
+					tags[column] = record[i]
+					continue
+				}
+				v, err := fluxValue(datatypes[i], record[i])
+				if err != nil {
+					return nil, err
+				}
+				fields[column] = v
+			}
+		}
+		k := strings.Join(key, ",")
+		i, found := index[k]
+		if !found {
+			row := influxDBModels.Row{Name: name, Tags: tags}
+			for column := range fields {
+				if column != "time" {
+					row.Columns = append(row.Columns, column)
+				}
+			}
+			sort.Strings(row.Columns)
+			if _, ok := fields["time"]; ok {
+				row.Columns = append([]string{"time"}, row.Columns...)
+			}
+			i = len(rows)
+			index[k] = i
+			rows = append(rows, row)
+		}
+		values := make([]interface{}, 0, len(rows[i].Columns))
+		for _, column := range rows[i].Columns {
+			values = append(values, fields[column])
+		}
+		rows[i].Values = append(rows[i].Values, values)
+	}
+}
+
+// fluxValue returns the Flux annotated CSV `value` of the `datatype` type, as it would be decoded
+// from an InfluxQL JSON response.
+func fluxValue(datatype, value string) (interface{}, error) {
+	if value == "" {
+		return nil, nil
+	}
+	switch datatype {
+	case "long", "unsignedLong", "double":
+		return json.Number(value), nil
+	case "boolean":
+		return value == "true", nil
+	case "string", "dateTime:RFC3339", "dateTime:RFC3339Nano", "duration", "base64Binary":
+		return value, nil
+	default:
+		return nil, fmt.Errorf("unexpected flux datatype: %s", datatype)
+	}
+}
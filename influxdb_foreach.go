@@ -0,0 +1,69 @@
+package appdash
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// ForEachTrace calls `fn` with each of the traces returned by Traces, in the same order. Unlike
+// Traces, each trace is queried right before `fn` is called with it, so only one trace is held
+// in memory at a time. Iteration stops at the first error returned by `fn`, which is returned
+// as is.
+func (in *InfluxDBStore) ForEachTrace(fn func(*Trace) error) error {
+	ctx := context.Background()
+	ids, err := in.rootIDs(ctx, rootsFilter{})
+	if err != nil {
+		return fmt.Errorf("appdash influxdb: querying traces: %w", err)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	roots, err := in.rootCursors(ctx, ids)
+	if err != nil {
+		return fmt.Errorf("appdash influxdb: querying traces: %w", err)
+	}
+	for _, root := range roots {
+		var trace *Trace
+		if root.hi == 0 {
+			trace, err = in.TraceContext(ctx, root.Trace)
+		} else {
+			trace, err = in.trace128(ctx, root.hi, root.Trace)
+		}
+		if err == ErrTraceNotFound {
+			continue // Deleted since it's root span was looked up.
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(trace); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rootCursors returns the cursors of the traces `ids`, sorted like Traces(newest root span first). Only
+// the root span times are queried, so `cursor.trace` is not set.
+func (in *InfluxDBStore) rootCursors(ctx context.Context, ids []ID) ([]*tracesCursor, error) {
+	// Selects a field every point has, so each series holds the times of all the root span points(oldest first).
+	q := fmt.Sprintf("SELECT %s FROM %s WHERE parent_id=%s AND %s GROUP BY trace_id, %s", schemasFieldName, quoteIdent(in.measurement), quoteTag(in.idEncoding.zero()), in.traceIDsCondition(ids), traceIDHighTag)
+	result, err := in.executeOneQuery(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	roots := make([]*tracesCursor, 0, len(result.Series))
+	for _, s := range result.Series {
+		key, err := rowTraceKey(&s, in.idEncoding)
+		if err != nil {
+			return nil, err
+		}
+		t, err := rowTime(&s)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, &tracesCursor{Time: t, Trace: key.id, hi: key.hi})
+	}
+	sort.Sort(tracesCursorsByTime(roots))
+	return roots, nil
+}
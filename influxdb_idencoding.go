@@ -0,0 +1,76 @@
+package appdash
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// IDEncoding is how InfluxDBStore encodes IDs on the trace_id, trace_id_hi, span_id & parent_id
+// tags, see InfluxDBStoreConfig.IDEncoding.
+type IDEncoding int
+
+const (
+	// HexIDEncoding encodes IDs as zero-padded hex strings(default, see ID.String), eg.
+	// "000000000098e004".
+	HexIDEncoding IDEncoding = iota
+
+	// DecimalIDEncoding encodes IDs as decimal strings, eg. "10018820".
+	DecimalIDEncoding
+)
+
+// String returns the name of `e`, eg. "hex".
+func (e IDEncoding) String() string {
+	switch e {
+	case HexIDEncoding:
+		return "hex"
+	case DecimalIDEncoding:
+		return "decimal"
+	default:
+		return fmt.Sprintf("IDEncoding(%d)", int(e))
+	}
+}
+
+// format returns `id` encoded as a tag value.
+func (e IDEncoding) format(id ID) string {
+	if e == DecimalIDEncoding {
+		return strconv.FormatUint(uint64(id), 10)
+	}
+	return id.String()
+}
+
+// parse decodes the tag value `s`, see format.
+func (e IDEncoding) parse(s string) (ID, error) {
+	if e == DecimalIDEncoding {
+		i, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return ID(i), nil
+	}
+	return ParseID(s)
+}
+
+// zero returns the zero ID(ie. the parent ID of root spans) encoded as a tag value.
+func (e IDEncoding) zero() string {
+	return e.format(0)
+}
+
+// checkIDEncoding returns an error if the database has root spans whose IDs were encoded
+// differently than `in.idEncoding`, since both encodings can't be mixed: the same ID would be
+// stored as two different tag values(eg. "0000000000000001" & "1").
+func (in *InfluxDBStore) checkIDEncoding() error {
+	other := DecimalIDEncoding
+	if in.idEncoding == DecimalIDEncoding {
+		other = HexIDEncoding
+	}
+	q := fmt.Sprintf("SELECT %s FROM %s WHERE parent_id=%s LIMIT 1", schemasFieldName, quoteIdent(in.measurement), quoteTag(other.zero()))
+	result, err := in.executeOneQuery(context.Background(), q)
+	if err != nil {
+		return err
+	}
+	if len(result.Series) > 0 {
+		return fmt.Errorf("database has spans with %s encoded IDs, but the %s encoding is configured", other, in.idEncoding)
+	}
+	return nil
+}
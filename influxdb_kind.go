@@ -0,0 +1,68 @@
+package appdash
+
+import "strings"
+
+// kindTag is the tag holding the kind of the span("client" or "server"), see spanKind.
+const kindTag = "kind"
+
+// Span kinds, see Span.Kind.
+const (
+	ClientSpanKind = "client"
+	ServerSpanKind = "server"
+)
+
+// spanKind returns the kind of the span annotated with `anns`: "client" or "server" as set by a
+// "span.kind"(like the OpenTracing tag) or "kind" annotation, in any case; empty if none.
+func spanKind(anns []Annotation) string {
+	for _, a := range anns {
+		if a.Key != "span.kind" && a.Key != kindTag {
+			continue
+		}
+		switch kind := strings.ToLower(string(a.Value)); kind {
+		case ClientSpanKind, ServerSpanKind:
+			return kind
+		}
+	}
+	return ""
+}
+
+// collapseClientServer merges each client span of `t`'s tree which has a single server child span
+// (ie. both sides of a call) into one node: the client span, with the server span's annotations
+// appended & it's children adopted. The times of the node cover both spans.
+func collapseClientServer(t *Trace) {
+	for _, sub := range t.Sub {
+		collapseClientServer(sub)
+	}
+	for _, sub := range t.UnattachedSpans {
+		collapseClientServer(sub)
+	}
+	if t.Kind != ClientSpanKind {
+		return
+	}
+	server := -1
+	for i, sub := range t.Sub {
+		if sub.Kind != ServerSpanKind {
+			continue
+		}
+		if server >= 0 {
+			return // Ambiguous, eg. retried calls.
+		}
+		server = i
+	}
+	if server < 0 {
+		return
+	}
+	s := t.Sub[server]
+	t.Annotations = append(t.Annotations, s.Annotations...)
+	if !s.Start.IsZero() && (t.Start.IsZero() || s.Start.Before(t.Start)) {
+		t.Start = s.Start
+	}
+	if s.End.After(t.End) {
+		t.End = s.End
+	}
+	sub := make([]*Trace, 0, len(t.Sub)-1+len(s.Sub))
+	sub = append(sub, t.Sub[:server]...)
+	sub = append(sub, s.Sub...)
+	sub = append(sub, t.Sub[server+1:]...)
+	t.Sub = sub
+}
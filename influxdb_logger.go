@@ -0,0 +1,29 @@
+package appdash
+
+// Logger logs the events of InfluxDBStore worth diagnosing it, see InfluxDBStoreConfig.Logger.
+// Implementations must be safe for concurrent use. A *log.Logger only lacks Debugf, eg.:
+//
+//	type logger struct{ *log.Logger }
+//
+//	func (l logger) Debugf(format string, v ...interface{}) {}
+type Logger interface {
+	// Printf logs events signalling a misbehaving store, eg. slow queries or reconnects.
+	Printf(format string, v ...interface{})
+
+	// Debugf logs routine events, eg. retention cleanup runs.
+	Debugf(format string, v ...interface{})
+}
+
+// nopLogger is a Logger which logs nothing.
+type nopLogger struct{}
+
+func (nopLogger) Printf(format string, v ...interface{}) {}
+func (nopLogger) Debugf(format string, v ...interface{}) {}
+
+// log returns the logger of the store, a nopLogger if none.
+func (in *InfluxDBStore) log() Logger {
+	if in.logger == nil {
+		return nopLogger{}
+	}
+	return in.logger
+}
@@ -0,0 +1,99 @@
+package appdash
+
+import (
+	"sort"
+	"time"
+
+	influxDBModels "github.com/influxdata/influxdb/models"
+)
+
+// mergeSeries merges the series of each span(identified by the trace_id, trace_id_hi, span_id & parent_id tags)
+// into a single series with a single point, which contains all the span's annotations.
+//
+// Collect writes a new point per call instead of rewriting the span's point(see spanPoint), so a span
+// may have multiple points, even on multiple series if it's indexed annotations were collected later.
+// Points are merged in time order: the span time is the time of it's first point, the schemas of all
+// points are merged, the last updated time is the one of the last point and for any other field the
+// first non-empty value is kept.
+func mergeSeries(series []influxDBModels.Row) ([]influxDBModels.Row, error) {
+	type point struct {
+		time   time.Time
+		fields map[string]interface{}
+	}
+	type span struct {
+		row     influxDBModels.Row
+		columns map[string]struct{}
+		points  []point
+	}
+	var (
+		spans []*span
+		index = make(map[[4]string]*span, len(series))
+	)
+	for _, s := range series {
+		key := [4]string{s.Tags["trace_id"], s.Tags[traceIDHighTag], s.Tags["span_id"], s.Tags["parent_id"]}
+		sp, found := index[key]
+		if !found {
+			sp = &span{
+				row:     influxDBModels.Row{Name: s.Name, Tags: make(map[string]string, len(s.Tags))},
+				columns: make(map[string]struct{}, len(s.Columns)),
+			}
+			index[key] = sp
+			spans = append(spans, sp)
+		}
+		for k, v := range s.Tags {
+			if v != "" || sp.row.Tags[k] == "" { // Indexed annotations not set on the series are empty.
+				sp.row.Tags[k] = v
+			}
+		}
+		for _, column := range s.Columns {
+			if _, present := sp.columns[column]; !present {
+				sp.columns[column] = struct{}{}
+				sp.row.Columns = append(sp.row.Columns, column)
+			}
+		}
+		for _, values := range s.Values {
+			p := point{fields: make(map[string]interface{}, len(values))}
+			for i, v := range values {
+				p.fields[s.Columns[i]] = v
+			}
+			if v, ok := p.fields["time"].(string); ok {
+				t, err := time.Parse(time.RFC3339Nano, v)
+				if err != nil {
+					return nil, err
+				}
+				p.time = t
+			}
+			sp.points = append(sp.points, p)
+		}
+	}
+
+	merged := make([]influxDBModels.Row, 0, len(spans))
+	for _, sp := range spans {
+		sort.SliceStable(sp.points, func(i, j int) bool { return sp.points[i].time.Before(sp.points[j].time) })
+		fields := make(map[string]interface{}, len(sp.row.Columns))
+		for _, p := range sp.points {
+			for k, v := range p.fields {
+				switch {
+				case v == nil:
+				case k == schemasFieldName:
+					schemas, err := mergeSchemasField(fields[k], v)
+					if err != nil {
+						return nil, err
+					}
+					fields[k] = schemas
+				case k == lastUpdatedFieldName:
+					fields[k] = v
+				case fields[k] == nil || fields[k] == "":
+					fields[k] = v
+				}
+			}
+		}
+		values := make([]interface{}, len(sp.row.Columns))
+		for i, column := range sp.row.Columns {
+			values[i] = fields[column]
+		}
+		sp.row.Values = [][]interface{}{values}
+		merged = append(merged, sp.row)
+	}
+	return merged, nil
+}
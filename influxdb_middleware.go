@@ -0,0 +1,31 @@
+package appdash
+
+import "context"
+
+// CollectFunc collects a span, like InfluxDBStore.Collect.
+type CollectFunc func(id SpanID, anns ...Annotation) error
+
+// CollectMiddleware wraps the collection of spans, see InfluxDBStoreConfig.CollectMiddleware. It
+// returns a CollectFunc which may change the span(eg. enrich or scrub it's annotations), drop it
+// (by not calling `next`) or observe it, before or after calling `next` to collect it.
+type CollectMiddleware func(next CollectFunc) CollectFunc
+
+// chainCollect returns `collect` wrapped by `middleware`, the first one being the outermost(ie. the
+// first called).
+func chainCollect(collect CollectFunc, middleware []CollectMiddleware) CollectFunc {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		collect = middleware[i](collect)
+	}
+	return collect
+}
+
+// collectChain returns the CollectFunc collecting spans through the middleware with `ctx`, see
+// CollectContext.
+func (in *InfluxDBStore) collectChain(ctx context.Context) CollectFunc {
+	if ctx == context.Background() && in.chain != nil {
+		return in.chain // Built once, see NewInfluxDBStore.
+	}
+	return chainCollect(func(id SpanID, anns ...Annotation) error {
+		return in.collect(ctx, id, anns...)
+	}, in.middleware)
+}
@@ -0,0 +1,103 @@
+package appdash
+
+import (
+	"crypto/tls"
+
+	influxDBServer "github.com/influxdata/influxdb/cmd/influxd/run"
+)
+
+// InfluxDBStoreOption sets an InfluxDBStoreConfig setting, see NewInfluxDBStoreOpts.
+type InfluxDBStoreOption func(*InfluxDBStoreConfig)
+
+// NewInfluxDBStoreOpts is like NewInfluxDBStore, but the config is built from `opts`, which must
+// include WithAdminUser. Unless an external server is set(see WithExternalURL), an embedded server
+// is started with the InfluxDB demo settings & authentication enabled(see WithServer).
+func NewInfluxDBStoreOpts(opts ...InfluxDBStoreOption) (*InfluxDBStore, error) {
+	config, err := newInfluxDBStoreConfig(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewInfluxDBStore(config)
+}
+
+// newInfluxDBStoreConfig returns the config built from `opts`, see NewInfluxDBStoreOpts.
+func newInfluxDBStoreConfig(opts ...InfluxDBStoreOption) (InfluxDBStoreConfig, error) {
+	var config InfluxDBStoreConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+	if config.ExternalURL != "" {
+		return config, nil
+	}
+	if config.Server == nil {
+		server, err := influxDBServer.NewDemoConfig()
+		if err != nil {
+			return InfluxDBStoreConfig{}, err
+		}
+		server.HTTPD.AuthEnabled = true
+		config.Server = server
+	}
+	if config.BuildInfo == nil {
+		config.BuildInfo = &influxDBServer.BuildInfo{}
+	}
+	return config, nil
+}
+
+// WithAdminUser sets the InfluxDB server auth credentials, see InfluxDBStoreConfig.AdminUser.
+func WithAdminUser(username, password string) InfluxDBStoreOption {
+	return func(c *InfluxDBStoreConfig) {
+		c.AdminUser = InfluxDBAdminUser{Username: username, Password: password}
+	}
+}
+
+// WithServer sets the settings of the embedded InfluxDB server, see InfluxDBStoreConfig.Server.
+func WithServer(server *influxDBServer.Config) InfluxDBStoreOption {
+	return func(c *InfluxDBStoreConfig) {
+		c.Server = server
+	}
+}
+
+// WithExternalURL makes the store connect to an existing InfluxDB server, see InfluxDBStoreConfig.ExternalURL.
+func WithExternalURL(url string) InfluxDBStoreOption {
+	return func(c *InfluxDBStoreConfig) {
+		c.ExternalURL = url
+	}
+}
+
+// WithMeasurement sets the InfluxDB measurement where spans are stored, see InfluxDBStoreConfig.Measurement.
+func WithMeasurement(measurement string) InfluxDBStoreOption {
+	return func(c *InfluxDBStoreConfig) {
+		c.Measurement = measurement
+	}
+}
+
+// WithTracesPerPage sets the number of traces per page, see InfluxDBStoreConfig.TracesPerPage.
+func WithTracesPerPage(n int) InfluxDBStoreOption {
+	return func(c *InfluxDBStoreConfig) {
+		c.TracesPerPage = n
+	}
+}
+
+// WithTLS makes the store connect to InfluxDB using HTTPS with the given TLS settings(if nil, the
+// default settings are used), see InfluxDBStoreConfig.Secure.
+func WithTLS(config *tls.Config) InfluxDBStoreOption {
+	return func(c *InfluxDBStoreConfig) {
+		c.Secure = true
+		c.TLSConfig = config
+	}
+}
+
+// WithRetentionPolicy sets the default retention policy of the database, see InfluxDBStoreConfig.DefaultRP.
+func WithRetentionPolicy(name, duration string) InfluxDBStoreOption {
+	return func(c *InfluxDBStoreConfig) {
+		c.DefaultRP = InfluxDBRetentionPolicy{Name: name, Duration: duration}
+	}
+}
+
+// WithCollectMiddleware registers `middleware` after the already registered ones, see
+// InfluxDBStoreConfig.CollectMiddleware.
+func WithCollectMiddleware(middleware ...CollectMiddleware) InfluxDBStoreOption {
+	return func(c *InfluxDBStoreConfig) {
+		c.CollectMiddleware = append(c.CollectMiddleware, middleware...)
+	}
+}
@@ -0,0 +1,132 @@
+package appdash
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// TraceQuery filters, sorts & limits the traces returned by InfluxDBStore.QueryTraces, zero
+// fields are ignored. Filters are matched against the root span of each trace.
+type TraceQuery struct {
+	// Start & End are the time range(inclusive) of the root span.
+	Start, End time.Time
+
+	// SpanName is the name of the root span, see Span.Name.
+	SpanName string
+
+	// Annotations are the annotations(key -> value) the root span must have.
+	Annotations map[string]string
+
+	// Limit & Offset paginate the traces, if Limit is zero the default number of traces per page is used.
+	Limit, Offset int
+
+	// OrderDesc sorts the traces by root span time newest first, instead of oldest first.
+	OrderDesc bool
+}
+
+// QueryTraces returns the traces(including all it's spans) matched by `q`, sorted by root span time.
+//
+// A root span may be made of several points(ie. collected by separate Collect calls, see mergeSeries), so
+// it's points are grouped by trace before the traces are filtered & paginated(see roots): each filter is
+// matched by any point, the time range by the root span time & each trace counts once on Limit & Offset.
+func (in *InfluxDBStore) QueryTraces(q TraceQuery) ([]*Trace, error) {
+	traces, _, err := in.queryTraces(context.Background(), q, false)
+	return traces, err
+}
+
+// QueryTracesWithCount is like QueryTraces, but also returns the total number of traces matched by
+// `q`'s filters(ie. regardless of Limit & Offset), eg. for pagination controls. The total counts the
+// same traces which are paginated, so paging through all of them returns exactly `total` traces.
+func (in *InfluxDBStore) QueryTracesWithCount(q TraceQuery) ([]*Trace, int64, error) {
+	return in.queryTraces(context.Background(), q, true)
+}
+
+// queryTraces returns the traces matched by `q`, along with the total number of traces matched by it's
+// filters if `count` is set(otherwise the traces after the page may not be read, see queryRoots).
+func (in *InfluxDBStore) queryTraces(ctx context.Context, q TraceQuery, count bool) ([]*Trace, int64, error) {
+	if err := q.checkQuotable(); err != nil {
+		return nil, 0, fmt.Errorf("appdash influxdb: querying traces: %w", err)
+	}
+	limit := 0
+	if q.OrderDesc && q.Limit > 0 && !count {
+		limit = q.Offset + q.Limit // Newest first, so the traces after the page are left out.
+	}
+	roots, err := in.queryRoots(ctx, q, limit)
+	if err != nil {
+		return nil, 0, fmt.Errorf("appdash influxdb: querying traces: %w", err)
+	}
+	total := int64(len(roots))
+	if roots, err = in.rootsTraces(ctx, q.page(roots, in.tracesPerPage)); err != nil {
+		return nil, 0, fmt.Errorf("appdash influxdb: querying traces: %w", err)
+	}
+	return cursorsTraces(roots), total, nil
+}
+
+// TracesWithCount returns a page of up to `limit` traces(newest first) skipping the first `offset`
+// ones, & the total number of traces, see QueryTracesWithCount.
+func (in *InfluxDBStore) TracesWithCount(limit, offset int) (traces []*Trace, total int64, err error) {
+	return in.QueryTracesWithCount(TraceQuery{Limit: limit, Offset: offset, OrderDesc: true})
+}
+
+// checkQuotable returns an error if the filters of `q` can't be quoted into a query, see checkQuotable.
+func (q TraceQuery) checkQuotable() error {
+	values := []string{encodeAnnotationValue([]byte(q.SpanName))}
+	for k, v := range q.Annotations {
+		values = append(values, k, encodeAnnotationValue([]byte(v)))
+	}
+	return checkQuotable(values...)
+}
+
+// queryRoots returns the cursors(without `trace`) of the traces matched by `q`'s filters, in order. Only
+// the `limit` newest ones are returned, unless it's zero.
+func (in *InfluxDBStore) queryRoots(ctx context.Context, q TraceQuery, limit int) ([]*tracesCursor, error) {
+	f := rootsFilter{start: q.Start, end: q.End, where: in.rootsConditions(q), limit: limit}
+	roots, _, err := in.roots(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	if !q.OrderDesc {
+		for i, j := 0, len(roots)-1; i < j; i, j = i+1, j-1 {
+			roots[i], roots[j] = roots[j], roots[i]
+		}
+	}
+	return roots, nil
+}
+
+// page returns the page of `roots`(in order) selected by `q`'s Limit & Offset, `perPage` is the default limit.
+func (q TraceQuery) page(roots []*tracesCursor, perPage int) []*tracesCursor {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = perPage
+	}
+	if q.Offset >= len(roots) {
+		return nil
+	}
+	roots = roots[q.Offset:]
+	if len(roots) > limit {
+		roots = roots[:limit]
+	}
+	return roots
+}
+
+// rootsConditions returns the conditions(see rootsFilter) of the root spans matched by `q`'s filters,
+// but the time range.
+func (in *InfluxDBStore) rootsConditions(q TraceQuery) []string {
+	var where []string
+	if q.SpanName != "" {
+		where = append(where, fmt.Sprintf("%s=%s", quoteIdent(nameAnnotationKey), quoteTag(encodeAnnotationValue([]byte(q.SpanName)))))
+	}
+
+	// Sorted, so the same queries are always performed for the same annotations.
+	keys := make([]string, 0, len(q.Annotations))
+	for k := range q.Annotations {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		where = append(where, fmt.Sprintf("%s=%s", quoteIdent(k), quoteTag(encodeAnnotationValue([]byte(q.Annotations[k])))))
+	}
+	return where
+}
@@ -0,0 +1,89 @@
+package appdash
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// writeLimiter is a token bucket rate limiting writes, see InfluxDBStoreConfig.MaxWritesPerSecond.
+// A nil *writeLimiter doesn't limit writes.
+type writeLimiter struct {
+	mu      sync.Mutex
+	rate    float64       // Tokens added per second.
+	burst   float64       // Maximum number of tokens.
+	maxWait time.Duration // Maximum wait for a token.
+	tokens  float64       // Available tokens, negative when writes are waiting for theirs.
+	last    time.Time     // Time `tokens` was last updated.
+}
+
+// newWriteLimiter returns a limiter of `rate` writes per second with bursts of up to `burst`
+// writes(1 if not positive), nil if `rate` isn't positive.
+func newWriteLimiter(rate float64, burst int, maxWait time.Duration) *writeLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+	return &writeLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		maxWait: maxWait,
+		tokens:  float64(burst),
+		last:    time.Now(),
+	}
+}
+
+// wait takes a token, waiting for it up to `l.maxWait`; ErrRateLimited is returned if it would take
+// longer, or `ctx.Err()` if `ctx` is done first.
+func (l *writeLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	d, ok := l.reserve(time.Now())
+	if !ok {
+		return ErrRateLimited
+	}
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		l.cancel()
+		return ctx.Err()
+	}
+}
+
+// reserve takes a token at `now`, returning how long to wait until it's available. No token is
+// taken(false is returned) if the wait would exceed `l.maxWait`.
+func (l *writeLimiter) reserve(now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0, true
+	}
+	d := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	if d > l.maxWait {
+		return 0, false
+	}
+	l.tokens--
+	return d, true
+}
+
+// cancel gives back a token taken by reserve.
+func (l *writeLimiter) cancel() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens++
+}
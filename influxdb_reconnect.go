@@ -0,0 +1,203 @@
+package appdash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	influxDBClient "github.com/influxdata/influxdb/client"
+)
+
+// defaultReconnectBackoff is the wait before the first retry when InfluxDBStoreConfig.ReconnectBackoff is unset.
+const defaultReconnectBackoff = 100 * time.Millisecond
+
+const (
+	defaultStartupTimeout = 10 * time.Second      // Used when InfluxDBStoreConfig.StartupTimeout is unset.
+	readyPingInterval     = 50 * time.Millisecond // Wait between pings, see waitReady.
+)
+
+// conn returns the current connection to the InfluxDB server.
+func (in *InfluxDBStore) conn() *influxDBConn {
+	in.conMu.RLock()
+	defer in.conMu.RUnlock()
+	return in.con
+}
+
+// connect establishes a new connection to the InfluxDB server, replacing the current one(if any).
+func (in *InfluxDBStore) connect() error {
+	rawURL := in.externalURL
+	if rawURL == "" {
+		rawURL = fmt.Sprintf("http://%s", net.JoinHostPort(in.host, strconv.Itoa(in.port)))
+	}
+	url, err := url.Parse(rawURL)
+	if err != nil {
+		return errors.New("invalid URL") // The parse error includes the URL, which may contain credentials.
+	}
+	if in.secure {
+		url.Scheme = "https"
+	}
+	con := newInfluxDBConn(influxDBConnConfig{
+		URL:            *url,
+		Username:       in.adminUser.Username,
+		Password:       in.adminUser.Password,
+		TLSConfig:      in.tlsConfig,
+		Token:          in.token,
+		Org:            in.org,
+		ConnectTimeout: in.connectTimeout,
+		WriteTimeout:   in.writeTimeout,
+	})
+	if in.queryUser.Username != "" {
+		con.reader = newInfluxDBConn(influxDBConnConfig{
+			URL:            *url,
+			Username:       in.queryUser.Username,
+			Password:       in.queryUser.Password,
+			TLSConfig:      in.tlsConfig,
+			ConnectTimeout: in.connectTimeout,
+		})
+	}
+	in.conMu.Lock()
+	old := in.con
+	in.con = con
+	in.conMu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// waitReady pings the InfluxDB server until it responds or `timeout`(defaultStartupTimeout if zero)
+// elapses, in which case the last ping error is returned.
+func (in *InfluxDBStore) waitReady(timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = defaultStartupTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var lastErr error
+	for {
+		_, _, err := in.conn().Ping(ctx)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() == nil {
+			lastErr = err // Pings cut short by the timeout fail with ctx.Err(), which says nothing about the server.
+		}
+		select {
+		case <-time.After(readyPingInterval):
+		case <-ctx.Done():
+			if lastErr == nil {
+				lastErr = ctx.Err()
+			}
+			return fmt.Errorf("not ready after %s: %w", timeout, lastErr)
+		}
+	}
+}
+
+// withReconnect calls `fn` with the current connection. If it fails transiently(see isRetryable), it's
+// retried up to `in.maxReconnectAttempts` times, waiting an exponential backoff & reconnecting before
+// each retry. Permanent failures are returned at once as a *PermanentError, failures caused by `ctx`
+// being done are never retried.
+func (in *InfluxDBStore) withReconnect(ctx context.Context, fn func(con *influxDBConn) error) error {
+	backoff := in.reconnectBackoff
+	if backoff <= 0 {
+		backoff = defaultReconnectBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		err := fn(in.conn())
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if !isRetryable(err) {
+			return permanent(err)
+		}
+		if attempt >= in.maxReconnectAttempts {
+			return err
+		}
+		wait := backoff << uint(attempt)
+		in.log().Printf("appdash influxdb: retrying in %s (retry %d of %d): %v", wait, attempt+1, in.maxReconnectAttempts, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		in.log().Printf("appdash influxdb: reconnecting")
+		if err := in.connect(); err != nil {
+			in.log().Printf("appdash influxdb: reconnecting: %v", err)
+			return err
+		}
+	}
+}
+
+// query sends `q` to the InfluxDB server, see withReconnect.
+func (in *InfluxDBStore) query(ctx context.Context, q influxDBClient.Query) (*influxDBClient.Response, error) {
+	var response *influxDBClient.Response
+	err := in.withReconnect(ctx, func(con *influxDBConn) error {
+		var err error
+		response, err = con.Query(ctx, q)
+		return err
+	})
+	return response, err
+}
+
+// readQuery is like query, but `q` is sent as the query user(if set), so it must be read-only.
+func (in *InfluxDBStore) readQuery(ctx context.Context, q influxDBClient.Query) (*influxDBClient.Response, error) {
+	var response *influxDBClient.Response
+	err := in.withReconnect(ctx, func(con *influxDBConn) error {
+		var err error
+		response, err = con.readConn().Query(ctx, q)
+		return err
+	})
+	return response, err
+}
+
+// PermanentError wraps an InfluxDB failure which is not worth retrying(eg. a query syntax error or
+// an authentication failure), as opposed to transient ones(eg. a connection reset or a busy server).
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+
+// Unwrap returns the wrapped error, so errors.Is & errors.As see through a *PermanentError.
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+// permanent returns `err` wrapped as a *PermanentError, unless it already is one or it's a
+// context error(which callers compare as is).
+func permanent(err error) error {
+	var permanentErr *PermanentError
+	if errors.As(err, &permanentErr) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return &PermanentError{Err: err}
+}
+
+// isRetryable reports whether `err` is a transient InfluxDB failure, which may succeed if retried:
+// network failures(eg. connection refused or reset) & server errors(5xx status codes, or 429 when
+// the server is busy). Other failures(eg. 4xx status codes or query errors) are permanent.
+func isRetryable(err error) bool {
+	var (
+		permanentErr *PermanentError
+		statusErr    *influxDBStatusError
+		urlErr       *url.Error
+	)
+	switch {
+	case err == nil, errors.As(err, &permanentErr):
+		return false
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false
+	case errors.As(err, &statusErr):
+		return statusErr.Code >= 500 || statusErr.Code == http.StatusTooManyRequests
+	case errors.As(err, &urlErr): // Failed to send the request or to read the response headers.
+		return true
+	case errors.Is(err, io.ErrUnexpectedEOF): // Response cut off.
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,61 @@
+package appdash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// CreateRetentionPolicy creates the retention policy `rp` on the store's database, which becomes the
+// default one(where spans are written) if `isDefault` is true. The database default retention policy
+// may also be set when it's created, see InfluxDBStoreConfig.DefaultRP.
+func (in *InfluxDBStore) CreateRetentionPolicy(rp InfluxDBRetentionPolicy, isDefault bool) error {
+	if err := validateRP(rp); err != nil {
+		return err
+	}
+	if rp.ReplicationFactor == 0 { // Required when creating retention policies.
+		rp.ReplicationFactor = 1
+	}
+	q := fmt.Sprintf("CREATE RETENTION POLICY %s ON %s %s", quoteIdent(rp.Name), quoteIdent(in.dbName), strings.Join(rp.clauses(), " "))
+	if isDefault {
+		q += " DEFAULT"
+	}
+	if _, err := in.executeOneStatement(context.Background(), q); err != nil {
+		return fmt.Errorf("appdash influxdb: creating retention policy %s: %w", rp.Name, err)
+	}
+	return nil
+}
+
+// AlterRetentionPolicy changes the settings of the existing retention policy `rp`(by name) on the
+// store's database, unset settings(except the duration) are kept. Data already older than the new
+// duration is dropped by InfluxDB.
+func (in *InfluxDBStore) AlterRetentionPolicy(rp InfluxDBRetentionPolicy) error {
+	if err := validateRP(rp); err != nil {
+		return err
+	}
+	q := fmt.Sprintf("ALTER RETENTION POLICY %s ON %s %s", quoteIdent(rp.Name), quoteIdent(in.dbName), strings.Join(rp.clauses(), " "))
+	if _, err := in.executeOneStatement(context.Background(), q); err != nil {
+		return fmt.Errorf("appdash influxdb: altering retention policy %s: %w", rp.Name, err)
+	}
+	return nil
+}
+
+// validateRP returns an error if `rp` has no name or invalid settings, so it's never sent to InfluxDB.
+func validateRP(rp InfluxDBRetentionPolicy) error {
+	if rp.Name == "" {
+		return errors.New("appdash influxdb: retention policy name required")
+	}
+	if err := validateRPDuration(rp.Duration); err != nil {
+		return fmt.Errorf("appdash influxdb: invalid retention policy duration %q: %w", rp.Duration, err)
+	}
+	if d := rp.ShardGroupDuration; d != "" {
+		if err := validateShardGroupDuration(d); err != nil {
+			return fmt.Errorf("appdash influxdb: invalid shard group duration %q: %w", d, err)
+		}
+	}
+	if rp.ReplicationFactor < 0 {
+		return fmt.Errorf("appdash influxdb: invalid replication factor %d", rp.ReplicationFactor)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package appdash
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MultiRootPolicy is how InfluxDBStore handles traces with multiple root spans(eg. cross-service
+// traces or instrumentation bugs), see InfluxDBStoreConfig.MultiRootPolicy.
+type MultiRootPolicy int
+
+const (
+	// MultiRootError fails reading such traces with a *MultipleRootsError(default).
+	MultiRootError MultiRootPolicy = iota
+
+	// MultiRootFirstByTime uses the earliest collected root span as the trace's root, the other
+	// root spans(and their children) are placed beneath it.
+	MultiRootFirstByTime
+
+	// MultiRootSynthesize creates a virtual root span(with a zero span ID & no annotations)
+	// parenting all the root spans.
+	MultiRootSynthesize
+)
+
+// MultipleRootsError is returned when reading a trace with multiple root spans, while
+// using the MultiRootError policy.
+type MultipleRootsError struct {
+	Trace ID       // ID of the trace.
+	Roots []SpanID // Conflicting root spans, sorted by collection time.
+}
+
+func (e *MultipleRootsError) Error() string {
+	roots := make([]string, 0, len(e.Roots))
+	for _, id := range e.Roots {
+		roots = append(roots, id.Span.String())
+	}
+	return fmt.Sprintf("appdash influxdb: unexpected multiple root spans on trace %s: %s", e.Trace, strings.Join(roots, ", "))
+}
+
+// rootSpan is a root span read from InfluxDB along with it's time.
+type rootSpan struct {
+	span *Span
+	time time.Time
+}
+
+// rootTrace returns the root trace of the trace `id` which has `roots` root spans, applying the
+// store's MultiRootPolicy if there is more than one.
+func (in *InfluxDBStore) rootTrace(id ID, roots []rootSpan) (*Trace, error) {
+	switch len(roots) {
+	case 0:
+		return &Trace{}, nil
+	case 1:
+		return &Trace{Span: *roots[0].span}, nil
+	}
+	sort.Sort(rootSpansByTime(roots))
+	switch in.multiRootPolicy {
+	case MultiRootFirstByTime:
+		root := &Trace{Span: *roots[0].span}
+		for _, r := range roots[1:] {
+			root.Sub = append(root.Sub, &Trace{Span: *r.span})
+		}
+		return root, nil
+	case MultiRootSynthesize:
+		root := &Trace{Span: Span{ID: SpanID{Trace: id}}}
+		for _, r := range roots {
+			root.Sub = append(root.Sub, &Trace{Span: *r.span})
+		}
+		return root, nil
+	default:
+		err := &MultipleRootsError{Trace: id}
+		for _, r := range roots {
+			err.Roots = append(err.Roots, r.span.ID)
+		}
+		return nil, err
+	}
+}
+
+// partialRoot returns the root of a trace whose root span is missing & it's remaining `children`
+// spans(along with the rest of them): the earliest(see `times`) of the highest in-tree spans,
+// those whose parent is missing too, or the earliest span if there are none(ie. a cycle).
+func partialRoot(children []*Trace, times map[ID]time.Time) (*Trace, []*Trace) {
+	spans := make(map[ID]struct{}, len(children))
+	for _, child := range children {
+		spans[child.ID.Span] = struct{}{}
+	}
+	// before reports whether `a` was collected before `b`, by span ID if at the same time.
+	before := func(a, b *Trace) bool {
+		ta, tb := times[a.ID.Span], times[b.ID.Span]
+		if !ta.Equal(tb) {
+			return ta.Before(tb)
+		}
+		return a.ID.Span < b.ID.Span
+	}
+	earliest := func(highest bool) int {
+		root := -1
+		for i, child := range children {
+			if _, found := spans[child.ID.Parent]; highest && found {
+				continue
+			}
+			if root == -1 || before(child, children[root]) {
+				root = i
+			}
+		}
+		return root
+	}
+	i := earliest(true)
+	if i == -1 {
+		i = earliest(false)
+	}
+	root := children[i]
+	rest := make([]*Trace, 0, len(children)-1)
+	rest = append(rest, children[:i]...)
+	return root, append(rest, children[i+1:]...)
+}
+
+type rootSpansByTime []rootSpan
+
+func (r rootSpansByTime) Len() int      { return len(r) }
+func (r rootSpansByTime) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r rootSpansByTime) Less(i, j int) bool {
+	if !r[i].time.Equal(r[j].time) {
+		return r[i].time.Before(r[j].time)
+	}
+	return r[i].span.ID.Span < r[j].span.ID.Span
+}
@@ -0,0 +1,284 @@
+package appdash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	influxDBModels "github.com/influxdata/influxdb/models"
+)
+
+// rootsFilter selects traces by their root span, see InfluxDBStore.roots.
+type rootsFilter struct {
+	start, end time.Time     // Time range(inclusive) of the root span, a zero `start` or `end` means unbounded on that side.
+	after      *tracesCursor // If set, only the traces going after it on the traces list are selected.
+	where      []string      // Conditions the root span must match, each one by any of it's points.
+	limit      int           // Maximum number of traces, unlimited if zero.
+}
+
+// selects reports whether the time range & `f.after` select `root`.
+func (f rootsFilter) selects(root *tracesCursor) bool {
+	if !f.start.IsZero() && root.Time.Before(f.start) {
+		return false
+	}
+	if !f.end.IsZero() && root.Time.After(f.end) {
+		return false
+	}
+	return f.after == nil || root.before(f.after)
+}
+
+// roots returns the cursors(without `trace`) of the traces selected by `f`, sorted like Traces(newest
+// root span first), and whether more of them were left out by `f.limit`.
+//
+// A root span may be made of several points(ie. collected by separate Collect calls, see mergeSeries)
+// & it's time is the time of the first one, so root span points are grouped by trace to select traces
+// by such time, never by the time of a later point. Only the end of the time range can be applied by
+// InfluxDB(the first point up to a time is the first point, unless it's later), so the rest of `f` is
+// applied here to the root span times up to it. Such times are all read, unless only the newest ones
+// are needed(see newestRoots & windowedRoots).
+func (in *InfluxDBStore) roots(ctx context.Context, f rootsFilter) ([]*tracesCursor, bool, error) {
+	end := f.end
+	if f.after != nil && (end.IsZero() || f.after.Time.Before(end)) {
+		end = f.after.Time
+	}
+	if len(f.where) == 0 && f.limit > 0 {
+		if in.subqueries {
+			return in.newestRoots(ctx, f, end)
+		}
+		return in.windowedRoots(ctx, f, end)
+	}
+	byKey, err := in.firstRootPoints(ctx, "", time.Time{}, end)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, condition := range f.where {
+		// Not bounded by `end`, the point matching `condition` may be later than the first one.
+		matched, err := in.firstRootPoints(ctx, condition, time.Time{}, time.Time{})
+		if err != nil {
+			return nil, false, err
+		}
+		for key := range byKey {
+			if _, present := matched[key]; !present {
+				delete(byKey, key)
+			}
+		}
+	}
+	roots := make([]*tracesCursor, 0, len(byKey))
+	for _, root := range byKey {
+		if f.selects(root) {
+			roots = append(roots, root)
+		}
+	}
+	sort.Sort(tracesCursorsByTime(roots))
+	more := f.limit > 0 && len(roots) > f.limit
+	if more {
+		roots = roots[:f.limit]
+	}
+	return roots, more, nil
+}
+
+// firstRootPoints returns the cursors(without `trace`) of the traces whose root span has a point matching
+// `condition`(any point if empty) within `start` & `end`(inclusive, unbounded if zero), set to the time
+// of the first such point.
+func (in *InfluxDBStore) firstRootPoints(ctx context.Context, condition string, start, end time.Time) (map[traceKey]*tracesCursor, error) {
+	where := fmt.Sprintf("parent_id=%s", quoteTag(in.idEncoding.zero()))
+	if condition != "" {
+		where += " AND " + condition
+	}
+	where += timeRangeCondition(start, end)
+
+	// One series per trace, first() returns the time of it's first point.
+	q := fmt.Sprintf("SELECT first(%s) FROM %s WHERE %s GROUP BY trace_id, %s", schemasFieldName, quoteIdent(in.measurement), where, traceIDHighTag)
+	result, err := in.executeOneQuery(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	roots := make(map[traceKey]*tracesCursor, len(result.Series))
+	for _, s := range result.Series {
+		key, err := rowTraceKey(&s, in.idEncoding)
+		if err != nil {
+			return nil, err
+		}
+		t, err := rowTime(&s)
+		if err != nil {
+			return nil, err
+		}
+		roots[key] = &tracesCursor{Time: t, Trace: key.id, hi: key.hi}
+	}
+	return roots, nil
+}
+
+// rootsVerifyBatch is the maximum number of traces whose earlier root span points are looked up by a
+// single query, see rootsBetween.
+const rootsVerifyBatch = 1000
+
+// rootsBetween returns the cursors(without `trace`) of the traces whose root span time(ie. the time of
+// it's first point) is within `start` & `end`(inclusive, unbounded if zero).
+//
+// Only the points within the time range are read, along with the earlier points of the traces found:
+// those with any are left out, as their first point is before `start`.
+func (in *InfluxDBStore) rootsBetween(ctx context.Context, start, end time.Time) (map[traceKey]*tracesCursor, error) {
+	roots, err := in.firstRootPoints(ctx, "", start, end)
+	if err != nil || start.IsZero() || len(roots) == 0 {
+		return roots, err
+	}
+	ids := make([]ID, 0, len(roots))
+	for key := range roots {
+		ids = append(ids, key.id)
+	}
+	sort.Sort(byID(ids))
+	for i := 0; i < len(ids); i += rootsVerifyBatch {
+		batch := ids[i:]
+		if len(batch) > rootsVerifyBatch {
+			batch = batch[:rootsVerifyBatch]
+		}
+		earlier, err := in.firstRootPoints(ctx, in.traceIDsCondition(batch), time.Time{}, start.Add(-time.Nanosecond))
+		if err != nil {
+			return nil, err
+		}
+		for key := range earlier {
+			delete(roots, key)
+		}
+	}
+	return roots, nil
+}
+
+// rootsWindow is the time range of the first window of root span times read by windowedRoots.
+const rootsWindow = time.Minute
+
+// windowedRoots is like newestRoots, but for servers without subqueries: root span times(see rootsBetween)
+// are read by windows of time going back from the newest one up to `end`, each twice as long as the
+// previous one, until more than `f.limit` traces are selected or there are no older root span times.
+func (in *InfluxDBStore) windowedRoots(ctx context.Context, f rootsFilter, end time.Time) ([]*tracesCursor, bool, error) {
+	newest, err := in.rootPointTime(ctx, "last", end)
+	if err != nil || newest.IsZero() {
+		return nil, false, err
+	}
+	oldest, err := in.rootPointTime(ctx, "first", end)
+	if err != nil {
+		return nil, false, err
+	}
+	var roots []*tracesCursor
+	for hi, width := newest, rootsWindow; ; width *= 2 {
+		lo := hi.Add(-width)
+		window, err := in.rootsBetween(ctx, lo, hi)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, root := range window {
+			if f.selects(root) {
+				roots = append(roots, root)
+			}
+		}
+
+		// Windows are read newest first, so the traces left out are older than those selected.
+		if len(roots) > f.limit || !lo.After(oldest) || (!f.start.IsZero() && !lo.After(f.start)) {
+			break
+		}
+		hi = lo.Add(-time.Nanosecond)
+	}
+	sort.Sort(tracesCursorsByTime(roots))
+	more := len(roots) > f.limit
+	if more {
+		roots = roots[:f.limit]
+	}
+	return roots, more, nil
+}
+
+// rootPointTime returns the time of the root span point selected by `selector`(ie. "first" or "last")
+// among those up to `end`(unbounded if zero), zero if there are none.
+func (in *InfluxDBStore) rootPointTime(ctx context.Context, selector string, end time.Time) (time.Time, error) {
+	q := fmt.Sprintf("SELECT %s(%s) FROM %s WHERE parent_id=%s%s", selector, schemasFieldName, quoteIdent(in.measurement), quoteTag(in.idEncoding.zero()), timeRangeCondition(time.Time{}, end))
+	result, err := in.executeOneQuery(ctx, q)
+	if err != nil || len(result.Series) == 0 {
+		return time.Time{}, err
+	}
+	return rowTime(&result.Series[0])
+}
+
+// newestRoots is like roots, but only the `f.limit` newest root span times up to `end` are read: they're
+// selected by InfluxDB with a subquery, which requires InfluxDB 1.2+ & a filter without conditions.
+//
+// Ties are sorted by trace ID here(see tracesCursor.before), so if the oldest root span time read may be
+// shared by traces left out(or if those going before `f.after` took their place), the query is repeated
+// reading twice as many times.
+func (in *InfluxDBStore) newestRoots(ctx context.Context, f rootsFilter, end time.Time) ([]*tracesCursor, bool, error) {
+	firsts := fmt.Sprintf("SELECT first(%s) AS first FROM %s WHERE parent_id=%s%s GROUP BY trace_id, %s", schemasFieldName, quoteIdent(in.measurement), quoteTag(in.idEncoding.zero()), timeRangeCondition(time.Time{}, end), traceIDHighTag)
+	for n := f.limit + 1; ; n *= 2 {
+		q := fmt.Sprintf("SELECT first, trace_id, %s FROM (%s) ORDER BY time DESC LIMIT %d", traceIDHighTag, firsts, n)
+		result, err := in.executeOneQuery(ctx, q)
+		if err != nil {
+			return nil, false, err
+		}
+		var (
+			roots  []*tracesCursor
+			read   int
+			oldest time.Time
+		)
+		for _, s := range result.Series {
+			rowRoots, err := in.rootsFromRow(&s)
+			if err != nil {
+				return nil, false, err
+			}
+			for _, root := range rowRoots {
+				read++
+				if oldest.IsZero() || root.Time.Before(oldest) {
+					oldest = root.Time
+				}
+				if f.selects(root) {
+					roots = append(roots, root)
+				}
+			}
+		}
+		sort.Sort(tracesCursorsByTime(roots))
+
+		// The traces left out are at most as new as the oldest one read.
+		complete := read < n || (len(roots) > f.limit && roots[f.limit-1].Time.After(oldest)) || (!f.start.IsZero() && oldest.Before(f.start))
+		if !complete {
+			continue
+		}
+		more := len(roots) > f.limit
+		if more {
+			roots = roots[:f.limit]
+		}
+		return roots, more, nil
+	}
+}
+
+// rootsFromRow returns the cursors(without `trace`) of `r`, a row of root span times along with their
+// trace_id & trace_id_hi columns(see newestRoots).
+func (in *InfluxDBStore) rootsFromRow(r *influxDBModels.Row) ([]*tracesCursor, error) {
+	columns := make(map[string]int, len(r.Columns))
+	for i, column := range r.Columns {
+		columns[column] = i
+	}
+	timeIdx, found := columns["time"]
+	if !found {
+		return nil, errors.New("time column not found")
+	}
+	traceIdx, found := columns["trace_id"]
+	if !found {
+		return nil, errors.New("trace_id column not found")
+	}
+	roots := make([]*tracesCursor, 0, len(r.Values))
+	for _, values := range r.Values {
+		tags := map[string]string{}
+		tags["trace_id"], _ = values[traceIdx].(string)
+		if i, found := columns[traceIDHighTag]; found {
+			tags[traceIDHighTag], _ = values[i].(string)
+		}
+		key, err := rowTraceKey(&influxDBModels.Row{Tags: tags}, in.idEncoding)
+		if err != nil {
+			return nil, err
+		}
+		v, _ := values[timeIdx].(string)
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, &tracesCursor{Time: t, Trace: key.id, hi: key.hi})
+	}
+	return roots, nil
+}
@@ -0,0 +1,20 @@
+package appdash
+
+import "math"
+
+// sampled reports whether the spans of the trace `id` are collected, see InfluxDBStoreConfig.SampleRate.
+func (in *InfluxDBStore) sampled(id ID) bool {
+	if in.sampleRate <= 0 || in.sampleRate >= 1 {
+		return true
+	}
+	return float64(mixID(id)) < in.sampleRate*math.MaxUint64
+}
+
+// mixID returns `id` hashed by the splitmix64 finalizer, so sequential or otherwise non-random IDs
+// are spread evenly too.
+func mixID(id ID) uint64 {
+	z := uint64(id)
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
@@ -0,0 +1,88 @@
+package appdash
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// StoreStats is a snapshot of the writes & queries performed by InfluxDBStore, see InfluxDBStore.Stats.
+type StoreStats struct {
+	Writes      int64 // Write requests(eg. one per Collect call, or per flush when buffering writes).
+	WriteErrors int64 // Write requests which failed.
+	Queries     int64 // Queries & statements, including those performed to set up the store.
+	QueryErrors int64 // Queries & statements which failed.
+
+	// DroppedPoints are the spans' points dropped as the write buffer was full, see
+	// InfluxDBStoreConfig.MaxBufferedPoints.
+	DroppedPoints int64
+
+	LastWrite time.Time // Time of the last write request, zero if none.
+	LastQuery time.Time // Time of the last query, zero if none.
+}
+
+// storeStats are the counters of StoreStats, updated atomically. A nil *storeStats counts nothing.
+type storeStats struct {
+	writes, writeErrors  int64
+	queries, queryErrors int64
+	lastWrite, lastQuery int64 // Unix nanoseconds, zero if none.
+	dropped              int64
+}
+
+// Stats returns a snapshot of the writes & queries performed by the store, eg. for tests or lightweight
+// monitoring without a metrics system(see InfluxDBStoreConfig.Metrics). Counters are updated atomically,
+// but not all at once: a snapshot taken while writing may count the write but not it's time.
+func (in *InfluxDBStore) Stats() StoreStats {
+	s := in.stats
+	if s == nil {
+		return StoreStats{}
+	}
+	return StoreStats{
+		Writes:        atomic.LoadInt64(&s.writes),
+		WriteErrors:   atomic.LoadInt64(&s.writeErrors),
+		Queries:       atomic.LoadInt64(&s.queries),
+		QueryErrors:   atomic.LoadInt64(&s.queryErrors),
+		DroppedPoints: atomic.LoadInt64(&s.dropped),
+		LastWrite:     statsTime(atomic.LoadInt64(&s.lastWrite)),
+		LastQuery:     statsTime(atomic.LoadInt64(&s.lastQuery)),
+	}
+}
+
+// observeWrite counts a write request performed at `t`, which failed if `err` isn't nil.
+func (s *storeStats) observeWrite(t time.Time, err error) {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.writes, 1)
+	if err != nil {
+		atomic.AddInt64(&s.writeErrors, 1)
+	}
+	atomic.StoreInt64(&s.lastWrite, t.UnixNano())
+}
+
+// observeQuery counts a query performed at `t`, which failed if `err` isn't nil.
+func (s *storeStats) observeQuery(t time.Time, err error) {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.queries, 1)
+	if err != nil {
+		atomic.AddInt64(&s.queryErrors, 1)
+	}
+	atomic.StoreInt64(&s.lastQuery, t.UnixNano())
+}
+
+// observeDropped counts `n` dropped points.
+func (s *storeStats) observeDropped(n int64) {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.dropped, n)
+}
+
+// statsTime returns the time of `ns`(Unix nanoseconds), zero if `ns` is.
+func statsTime(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns).UTC()
+}
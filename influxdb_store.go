@@ -1,25 +1,46 @@
 package appdash
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"net"
 	"net/url"
 	"reflect"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	influxDBClient "github.com/influxdata/influxdb/client"
 	influxDBServer "github.com/influxdata/influxdb/cmd/influxd/run"
 	influxDBModels "github.com/influxdata/influxdb/models"
+	influxDBHTTPD "github.com/influxdata/influxdb/services/httpd"
 	influxDBErrors "github.com/influxdata/influxdb/services/meta"
 )
 
 const (
 	defaultTracesPerPage  int    = 10             // Default number of traces per page.
+	defaultMaxChildren    int    = 100000         // Default maximum number of spans read by a query of traces.
+	spansChunkSize        int    = 1000           // Number of spans(series) read per request, see querySpans.
 	releaseDBName         string = "appdash"      // InfluxDB release DB name.
+	binaryValuePrefix     string = "base64:"      // Prefix of the annotation values stored base64 encoded.
+	durationFieldName     string = "duration_ns"  // Span's measurement field name for the span duration(nanoseconds).
+	firstSeenFieldName    string = "first_seen"   // Span's measurement field name for the time it was first collected(Unix nanoseconds).
+	lastUpdatedFieldName  string = "last_updated" // Span's measurement field name for the time it was last collected(Unix nanoseconds).
 	schemasFieldName      string = "schemas"      // Span's measurement field name for schemas field.
-	schemasFieldSeparator string = ","            // Span's measurement character separator for schemas field.
-	spanMeasurementName   string = "spans"        // InfluxDB container name for trace spans.
+	schemasFieldSeparator string = ","            // Span's measurement character separator for schemas field(legacy format).
+	spanMeasurementName   string = "spans"        // Default InfluxDB container name for trace spans.
 	testDBName            string = "appdash_test" // InfluxDB test DB name (will be deleted entirely in test mode).
 )
 
@@ -36,232 +57,1182 @@ var _ interface {
 	Queryer
 } = (*InfluxDBStore)(nil)
 
-// zeroID is ID's zero value as string.
-var zeroID string = ID(0).String()
+var _ DeleteStore = (*InfluxDBStore)(nil)
 
-// pointFields -> influxDBClient.Point.Fields
-type pointFields map[string]interface{}
+// zeroID is ID's zero value as string, hex encoded(see HexIDEncoding).
+var zeroID string = ID(0).String()
 
+// InfluxDBStore is a Store & Queryer backed by InfluxDB, either an embedded server or an external one.
+//
+// It's safe for concurrent use: queries may run concurrently with each other and with Collect calls,
+// and concurrent Collect calls for the same span never overwrite each other's annotations.
+//
+// Spans may be collected in any order(eg. children before their parent, or a server span before
+// it's client span): Collect never looks up a span's parent, trace trees are assembled on read
+// instead, so they're complete once all their spans were collected(see addChildren).
 type InfluxDBStore struct {
 	adminUser InfluxDBAdminUser       // InfluxDB server auth credentials.
-	con       *influxDBClient.Client  // InfluxDB client connection.
+	con       *influxDBConn           // InfluxDB client connection.
+	conMu     sync.RWMutex            // Protects `con`, which is replaced on reconnections.
 	dbName    string                  // InfluxDB database name for this store.
 	defaultRP InfluxDBRetentionPolicy // Default retention policy for `dbName`.
 
+	// When set, `con` connects to an external InfluxDB server at this URL and no embedded server is started.
+	externalURL string
+
+	queryUser InfluxDBAdminUser // Credentials of the read-only user, see InfluxDBStoreConfig.QueryUser.
+
+	token string // InfluxDB 2.x authentication token, see InfluxDBStoreConfig.Token.
+	org   string // InfluxDB 2.x organization, see InfluxDBStoreConfig.Org.
+
+	host      string      // InfluxDB server host.
+	port      int         // InfluxDB server port.
+	secure    bool        // Whether `con` connects to InfluxDB using HTTPS.
+	tlsConfig *tls.Config // TLS settings used by `con` for HTTPS connections.
+
+	pointTimeMu   sync.Mutex // Protects `lastPointTime`.
+	lastPointTime time.Time  // Time of the last point to be written, see pointTime.
+
+	// Read-your-writes, see InfluxDBStoreConfig.ReadYourWrites & awaitWrites.
+	readYourWrites bool
+	watermarkMu    sync.Mutex // Protects `lastWritten` & `lastVisible`.
+	lastWritten    time.Time  // Time of the newest point written.
+	lastVisible    time.Time  // Time of the newest written point known to be queryable.
+
+	// Tenants' databases, see WithTenant.
+	tenantsMu sync.Mutex      // Protects `tenantDBs`, held while setting up a tenant's database.
+	tenantDBs map[string]bool // Tenants whose database is set up, by tenant.
+
 	// When set to `testMode` - `testDBName` will be dropped and created, so newly database is ready for tests.
 	mode          mode                   // Used to check current mode(release or test).
-	server        *influxDBServer.Server // InfluxDB API server.
+	server        *influxDBServer.Server // InfluxDB API server, nil when connected to an external server.
 	tracesPerPage int                    // Number of traces per page.
+	measurement   string                 // InfluxDB container name for trace spans.
+
+	tracesQueryConcurrency int // Concurrent queries fetching the spans of a page of traces, see traceSpans.
+
+	buildInfo *influxDBServer.BuildInfo // Build info of `server`, nil when connected to an external server.
+
+	indexedAnnotations map[string]struct{} // Annotation keys set as tags instead of fields.
+	labels             map[string]string   // Tags set on every point, see InfluxDBStoreConfig.Labels.
+	tagRegexps         bool                // Whether the InfluxDB server supports regular expressions on tags.
+	subqueries         bool                // Whether the InfluxDB server supports subqueries.
+	multiRootPolicy    MultiRootPolicy     // How traces with multiple root spans are handled.
+	maxChildren        int                 // Maximum number of spans read by a query of traces.
+	queryLanguage      QueryLanguage       // Language used to query traces.
+	idEncoding         IDEncoding          // Encoding of the IDs on tags.
+	writeConsistency   string              // Consistency level of writes, see InfluxDBStoreConfig.WriteConsistency.
+
+	collapseClientServer bool // Merge client & server spans of a call, see collapseClientServer.
+
+	// UDP writes, see InfluxDBStoreConfig.WriteProtocol & InfluxDBStoreConfig.UDPAddr.
+	writeProtocol WriteProtocol
+	udpAddr       string
+	udp           net.Conn // Connection to the UDP listener, nil when writing through HTTP.
+
+	// Reconnection, see InfluxDBStoreConfig.MaxReconnectAttempts & InfluxDBStoreConfig.ReconnectBackoff.
+	maxReconnectAttempts int
+	reconnectBackoff     time.Duration
+
+	startupTimeout time.Duration // How long the embedded server is waited for to be ready.
+
+	// Client timeouts, see InfluxDBStoreConfig.ConnectTimeout & InfluxDBStoreConfig.WriteTimeout.
+	connectTimeout time.Duration
+	writeTimeout   time.Duration
+
+	traceCache *traceCache // Recently queried traces, nil if disabled.
+
+	collected    *collectedPoints // Recently written points, see CollectContext.
+	traceIDHighs *traceIDHighs    // High trace ID bits of recently collected 128-bit traces, see TraceIDHighAnnotationKey.
+
+	sampleRate float64 // Fraction of traces collected, see sampled.
+
+	limiter *writeLimiter // Rate limits Collect & CollectBatch, nil if disabled.
+
+	breaker *circuitBreaker // Fast-fails writes while InfluxDB is down, nil if disabled.
+
+	onCollect            func(id SpanID, anns []Annotation) // Called for every collected span, may be nil.
+	transformAnnotations func([]Annotation) []Annotation    // Applied to the annotations of every collected span, may be nil.
+
+	middleware []CollectMiddleware // Wraps Collect & CollectContext, see collectChain.
+	chain      CollectFunc         // The middleware chain of Collect, nil if no middleware.
+
+	metrics InfluxDBMetrics // Observes writes & queries, may be nil.
+	stats   *storeStats     // Counts writes & queries, see Stats.
+
+	logger             Logger        // Logs notable events, may be nil(see log).
+	slowQueryThreshold time.Duration // Queries taking longer are logged, zero if disabled.
+	queryTimeout       time.Duration // Queries taking longer are aborted, zero if disabled.
+
+	closeOnce sync.Once // Makes Close idempotent.
+	closeErr  error     // Returned by Close, once closed.
+
+	// Retention cleanup, see InfluxDBStoreConfig.MaxAge & InfluxDBStoreConfig.CleanupInterval.
+	maxAge          time.Duration
+	cleanupInterval time.Duration
+	cleanupStop     chan struct{} // Closed to stop the retention cleanups.
+	cleanupDone     chan struct{} // Closed once the retention cleanups are stopped.
+	onTraceExpired  func(id ID)   // Called for every trace deleted by the retention cleanups, may be nil.
+
+	// Write buffering, see InfluxDBStoreConfig.BatchSize & InfluxDBStoreConfig.FlushInterval.
+	batchSize     int
+	flushInterval time.Duration
+	bufferMu      sync.Mutex                        // Protects `buffer` & `bufferOrder`.
+	buffer        map[spanKey]*influxDBClient.Point // Span's points pending to be written.
+	flushStop     chan struct{}                     // Closed to stop the periodic flushes.
+	flushDone     chan struct{}                     // Closed once the periodic flushes are stopped.
+	writeErrors   chan error                        // Failures of the periodic flushes, see WriteErrors.
+
+	// Write buffer bound, see InfluxDBStoreConfig.MaxBufferedPoints & InfluxDBStoreConfig.BufferFullPolicy.
+	maxBufferedPoints int
+	bufferFullPolicy  BufferFullPolicy
+	bufferOrder       []bufferedKey // Buffered spans, oldest first, see dropOldestPoint.
 }
 
 func (in *InfluxDBStore) Collect(id SpanID, anns ...Annotation) error {
-	// Find a span's point, if found it will be rewritten with new given annotations(`anns`)
-	// if not found, a new span's point will be write to `in.dbName`.
-	p, err := in.findSpanPoint(id)
+	return in.CollectContext(context.Background(), id, anns...)
+}
+
+// CollectContext is like Collect, but the queries & writes it performs are
+// aborted once `ctx` is cancelled or its deadline passes.
+func (in *InfluxDBStore) CollectContext(ctx context.Context, id SpanID, anns ...Annotation) error {
+	if len(in.middleware) == 0 {
+		return in.collect(ctx, id, anns...)
+	}
+	return in.collectChain(ctx)(id, anns...)
+}
+
+// collect collects the span, once through the middleware(see InfluxDBStoreConfig.CollectMiddleware).
+func (in *InfluxDBStore) collect(ctx context.Context, id SpanID, anns ...Annotation) error {
+	if !in.sampled(id.Trace) {
+		return nil
+	}
+	if err := in.limiter.wait(ctx); err != nil {
+		return fmt.Errorf("appdash influxdb: collecting span %s: %w", id, err)
+	}
+	if in.transformAnnotations != nil {
+		anns = in.transformAnnotations(anns)
+	}
+	p := in.spanPoint(id, anns)
+	tenant := tenantFromContext(ctx)
+	in.traceIDHighs.tag(tenant, id.Trace, p)
+
+	// Re-collecting a span with the exact same annotations changes nothing, so it's not written(see collectedPoints).
+	d := tenantDigest(tenant, digestPoint(p))
+	written, err := in.collected.claim(ctx, d)
 	if err != nil {
-		return err
+		return fmt.Errorf("appdash influxdb: collecting span %s: %w", id, err)
+	}
+	if written {
+		if in.onCollect != nil {
+			in.onCollect(id, anns)
+		}
+		return nil
 	}
+	if in.buffering() && tenant == "" { // The buffer is flushed to `in.dbName`.
+		if err := in.bufferPoint(ctx, id, p); err == errPointDropped { // See BufferFullDropNewest.
+			in.collected.done(d, false)
+			return nil
+		} else if err != nil {
+			in.collected.done(d, false)
+			return fmt.Errorf("appdash influxdb: collecting span %s: %w", id, err)
+		}
+	} else {
+		// A single point represents one span's annotations.
+		if err := in.writePoints(ctx, []influxDBClient.Point{*p}); err != nil {
+			in.collected.done(d, false)
+			return fmt.Errorf("appdash influxdb: collecting span %s: %w", id, err)
+		}
+	}
+	in.collected.done(d, true)
+	if in.onCollect != nil {
+		in.onCollect(id, anns)
+	}
+	return nil
+}
 
+// CollectBatch is like calling Collect for each span on `spans`(span ID -> annotations), but all
+// the spans are written within a single request.
+func (in *InfluxDBStore) CollectBatch(spans map[SpanID][]Annotation) error {
+	ctx := context.Background()
+	if err := in.limiter.wait(ctx); err != nil {
+		return fmt.Errorf("appdash influxdb: collecting spans: %w", err)
+	}
+	var (
+		pts       = make([]influxDBClient.Point, 0, len(spans))
+		digests   = make([]pointDigest, 0, len(spans))
+		collected = make(map[SpanID][]Annotation, len(spans)) // Written spans, with their transformed annotations.
+	)
+	for id, anns := range spans {
+		if !in.sampled(id.Trace) {
+			continue
+		}
+		if in.transformAnnotations != nil {
+			anns = in.transformAnnotations(anns)
+		}
+		p := in.spanPoint(id, anns)
+		in.traceIDHighs.tag("", id.Trace, p) // See CollectContext.
+		d := digestPoint(p)
+		// See CollectContext. Spans being written by another call are written again instead of waiting for
+		// them, as that call may be waiting for the spans claimed by this one.
+		written, writing := in.collected.tryClaim(d)
+		if written {
+			if in.onCollect != nil {
+				in.onCollect(id, anns)
+			}
+			continue
+		}
+		claimed := writing == nil
+		if in.buffering() {
+			if err := in.bufferPoint(ctx, id, p); err == errPointDropped {
+				if claimed {
+					in.collected.done(d, false)
+				}
+				continue
+			} else if err != nil {
+				if claimed {
+					in.collected.done(d, false)
+				}
+				in.collected.doneAll(digests, false)
+				return fmt.Errorf("appdash influxdb: collecting span %s: %w", id, err)
+			}
+			if claimed {
+				in.collected.done(d, true)
+			}
+			if in.onCollect != nil {
+				in.onCollect(id, anns)
+			}
+			continue
+		}
+		pts = append(pts, *p)
+		if claimed {
+			digests = append(digests, d)
+		}
+		collected[id] = anns
+	}
+	if len(pts) == 0 {
+		return nil
+	}
+	if err := in.writePoints(ctx, pts); err != nil {
+		in.collected.doneAll(digests, false)
+		return fmt.Errorf("appdash influxdb: collecting spans: %w", err)
+	}
+	in.collected.doneAll(digests, true)
+	if in.onCollect != nil {
+		for id, anns := range collected {
+			in.onCollect(id, anns)
+		}
+	}
+	return nil
+}
+
+// spanPoint returns the point to be written for the span `id` with annotations `anns`.
+//
+// Collecting a span writes a new point which only contains `anns`, instead of reading & rewriting the
+// span's point, so a single write is performed and concurrent collects can't overwrite each other.
+// All the span's points are merged on read(see mergeSeries).
+func (in *InfluxDBStore) spanPoint(id SpanID, anns []Annotation) *influxDBClient.Point {
 	// trace_id, span_id & parent_id are mostly used as part of the "where" part on queries so
 	// to have performant queries these are set as tags(InfluxDB indexes tags).
 	tags := map[string]string{
-		"trace_id":  id.Trace.String(),
-		"span_id":   id.Span.String(),
-		"parent_id": id.Parent.String(),
+		"trace_id":  in.idEncoding.format(id.Trace),
+		"span_id":   in.idEncoding.format(id.Span),
+		"parent_id": in.idEncoding.format(id.Parent),
+	}
+	hi, anns := splitTraceIDHigh(anns)
+	if hi != 0 {
+		tags[traceIDHighTag] = in.idEncoding.format(hi)
+	}
+	for k, v := range in.labels {
+		tags[k] = encodeAnnotationValue([]byte(v))
 	}
 
-	// Annotations `anns` are set as fields(InfluxDB does not index fields).
+	// Annotations `anns` are set as fields(InfluxDB does not index fields), except
+	// indexed annotations(with non-empty values) which are set as tags.
 	fields := make(map[string]interface{}, len(anns))
 	for _, ann := range anns {
-		fields[ann.Key] = string(ann.Value)
+		if _, label := in.labels[ann.Key]; label {
+			continue
+		}
+		if _, indexed := in.indexedAnnotations[ann.Key]; indexed && len(ann.Value) > 0 {
+			tags[ann.Key] = encodeAnnotationValue(ann.Value)
+			continue
+		}
+		fields[ann.Key] = encodeAnnotationValue(ann.Value)
 	}
 
-	if p != nil { // span exists on `in.dbName`.
-		p.Measurement = spanMeasurementName
-		p.Tags = tags
+	// Erroring spans are tagged, so they're queried efficiently(see ErrorTraces). An "error" field
+	// would be ambiguous with the tag, & it's value is "true" anyway unless the span errored otherwise.
+	if spanError(anns) {
+		tags[errorTag] = "true"
+		delete(fields, errorTag)
+	}
 
-		// Using extendFields & withoutEmptyFields in order to have pointFields that only contains:
-		// - Fields that are not saved on DB.
-		// - Fields that are saved but have empty values.
-		fields := extendFields(fields, withoutEmptyFields(p.Fields))
-		schemas, err := mergeSchemasField(schemasFromAnnotations(anns), p.Fields[schemasFieldName])
-		if err != nil {
-			return err
-		}
+	// The span's kind is tagged too, so client & server spans are told apart(see Span.Kind). Like
+	// errors, a "kind" field would be ambiguous with the tag.
+	if kind := spanKind(anns); kind != "" {
+		tags[kindTag] = kind
+		delete(fields, kindTag)
+	}
 
-		// `schemas` contains the result of merging(without duplications)
-		// schemas already saved on DB and schemas present on `anns`.
-		fields[schemasFieldName] = schemas
-		p.Fields = fields
-	} else { // new span to be saved on DB.
+	// `schemasFieldName` field contains all the schemas found on `anns`.
+	// Eg. fields[schemasFieldName] = `["HTTPClient","HTTPServer"]`
+	fields[schemasFieldName] = schemasFromAnnotations(anns)
 
-		// `schemasFieldName` field contains all the schemas found on `anns`.
-		// Eg. fields[schemasFieldName] = "HTTPClient,HTTPServer"
-		fields[schemasFieldName] = schemasFromAnnotations(anns)
-		p = &influxDBClient.Point{
-			Measurement: spanMeasurementName,
-			Tags:        tags,
-			Fields:      fields,
-			Time:        time.Now().UTC(),
-		}
+	// Spans with timespan events have a numeric duration field, so they can be queried by duration.
+	if duration, timed := spanDuration(anns); timed {
+		fields[durationFieldName] = int64(duration)
 	}
 
-	// A single point represents one span.
-	pts := []influxDBClient.Point{*p}
-	bps := influxDBClient.BatchPoints{
-		Points:   pts,
-		Database: in.dbName,
-	}
-	_, writeErr := in.con.Write(bps)
-	if writeErr != nil {
-		return writeErr
+	// Every point records it's time as both the span's first seen & last updated times: the span's
+	// first point sets the former & it's last point the latter(see mergeSeries).
+	t := in.pointTime()
+	fields[firstSeenFieldName] = t.UnixNano()
+	fields[lastUpdatedFieldName] = t.UnixNano()
+
+	// Only the span's first point sets the span time(see mergeSeries), so the points written for
+	// later annotations never move the span within the timeline.
+	return &influxDBClient.Point{
+		Measurement: in.measurement,
+		Tags:        tags,
+		Fields:      fields,
+		Time:        t,
 	}
-	return nil
+}
+
+// pointTime returns the time for a new point, which is always after the time of the previous one so
+// points of the same span(same series) written at once are never overwritten by each other.
+func (in *InfluxDBStore) pointTime() time.Time {
+	in.pointTimeMu.Lock()
+	defer in.pointTimeMu.Unlock()
+	t := time.Now().UTC()
+	if !t.After(in.lastPointTime) {
+		t = in.lastPointTime.Add(time.Nanosecond)
+	}
+	in.lastPointTime = t
+	return t
 }
 
 func (in *InfluxDBStore) Trace(id ID) (*Trace, error) {
-	trace := &Trace{}
+	return in.TraceContext(context.Background(), id)
+}
+
+// TraceContext is like Trace, but the query it performs is aborted once `ctx`
+// is cancelled or its deadline passes.
+func (in *InfluxDBStore) TraceContext(ctx context.Context, id ID) (*Trace, error) {
+	if tenantFromContext(ctx) != "" { // Tenants' traces aren't cached, see WithTenant.
+		return in.trace(ctx, id)
+	}
+	if trace, ok := in.traceCache.get(id); ok {
+		return trace, nil
+	}
+	gen := in.traceCache.generation()
+	trace, err := in.trace(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	in.traceCache.add(id, trace, gen)
+	return trace, nil
+}
+
+// trace queries the trace `id`, see TraceContext.
+func (in *InfluxDBStore) trace(ctx context.Context, id ID) (*Trace, error) {
+	series, truncated, err := in.traceSeries(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// series -> A slice containing all the spans.
+	if len(series) == 0 {
+		return nil, ErrTraceNotFound
+	}
 
+	// 128-bit trace IDs may share their low 64 bits, the lowest high bits win(see Trace128).
+	his, byHigh, err := splitByTraceIDHigh(series, in.idEncoding)
+	if err != nil {
+		return nil, err
+	}
+	trace, err := in.traceFromSeries(traceKey{hi: his[0], id: id}, byHigh[his[0]])
+	if err != nil {
+		return nil, err
+	}
+	trace.Truncated = truncated
+	return trace, nil
+}
+
+// traceSeries returns the spans(see mergeSeries) of all the traces whose trace ID ends with `id`,
+// & whether some of them were truncated.
+func (in *InfluxDBStore) traceSeries(ctx context.Context, id ID) ([]influxDBModels.Row, bool, error) {
+	if in.queryLanguage == Flux {
+		series, err := in.fluxTraceSeries(ctx, id)
+		return series, false, err
+	}
 	// GROUP BY * -> meaning group by all tags(trace_id, span_id & parent_id)
 	// grouping by all tags includes those and it's values on the query response.
-	q := fmt.Sprintf("SELECT * FROM spans WHERE trace_id='%s' GROUP BY *", id)
-	result, err := in.executeOneQuery(q)
+	q := fmt.Sprintf("SELECT * FROM %s WHERE trace_id=%s GROUP BY *", quoteIdent(in.measurement), quoteTag(in.idEncoding.format(id)))
+	series, truncated, err := in.querySpans(ctx, q)
 	if err != nil {
+		return nil, false, fmt.Errorf("appdash influxdb: querying trace %s: %w", id, err)
+	}
+	return series, truncated, nil
+}
+
+// GetSpan returns the span `id`(without it's children), or ErrSpanNotFound if there is no such span.
+func (in *InfluxDBStore) GetSpan(id SpanID) (*Span, error) {
+	q := fmt.Sprintf("SELECT * FROM %s WHERE trace_id=%s AND span_id=%s GROUP BY *", quoteIdent(in.measurement), quoteTag(in.idEncoding.format(id.Trace)), quoteTag(in.idEncoding.format(id.Span)))
+	result, err := in.executeOneQuery(context.Background(), q)
+	if err != nil {
+		return nil, fmt.Errorf("appdash influxdb: querying span %s: %w", id, err)
+	}
+	if result.Series, err = mergeSeries(result.Series); err != nil {
 		return nil, err
 	}
+	if len(result.Series) == 0 {
+		return nil, ErrSpanNotFound
+	}
+	return newSpanFromRow(&result.Series[0], in.idEncoding)
+}
 
-	// result.Series -> A slice containing all the spans.
+// GetSpanRaw is like GetSpan, but returns all the stored fields & indexed annotations of the span as
+// it's annotations(sorted by key): including the time, schemas & duration fields, the annotations of
+// schemas not recorded on the schemas field(see filterSchemas) & those not belonging to any event.
+// It's meant for debugging how spans are stored only, raw annotations may not unmarshal into events.
+func (in *InfluxDBStore) GetSpanRaw(id SpanID) (*Span, error) {
+	q := fmt.Sprintf("SELECT * FROM %s WHERE trace_id=%s AND span_id=%s GROUP BY *", quoteIdent(in.measurement), quoteTag(in.idEncoding.format(id.Trace)), quoteTag(in.idEncoding.format(id.Span)))
+	result, err := in.executeOneQuery(context.Background(), q)
+	if err != nil {
+		return nil, fmt.Errorf("appdash influxdb: querying span %s: %w", id, err)
+	}
+	if result.Series, err = mergeSeries(result.Series); err != nil {
+		return nil, err
+	}
 	if len(result.Series) == 0 {
-		return nil, errors.New("trace not found")
+		return nil, ErrSpanNotFound
+	}
+	span, err := rawSpanFromRow(&result.Series[0], in.idEncoding)
+	if err != nil {
+		return nil, err
 	}
+	sort.Stable(annotationsByKey(span.Annotations))
+	return span, nil
+}
 
+// GetChildren returns the direct children spans of the span `id`(without their own children), so
+// large traces may be loaded on demand. An empty slice is returned if the span has no children.
+func (in *InfluxDBStore) GetChildren(id SpanID) ([]*Span, error) {
+	q := fmt.Sprintf("SELECT * FROM %s WHERE trace_id=%s AND parent_id=%s GROUP BY *", quoteIdent(in.measurement), quoteTag(in.idEncoding.format(id.Trace)), quoteTag(in.idEncoding.format(id.Span)))
+	series, _, err := in.querySpans(context.Background(), q)
+	if err != nil {
+		return nil, fmt.Errorf("appdash influxdb: querying children of span %s: %w", id, err)
+	}
+	children := make([]*Span, 0, len(series))
+	for _, s := range series {
+		span, err := newSpanFromRow(&s, in.idEncoding)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, span)
+	}
+	return children, nil
+}
+
+// traceFromSeries returns the trace `key` built from `series`, all of it's spans(see mergeSeries).
+func (in *InfluxDBStore) traceFromSeries(key traceKey, series []influxDBModels.Row) (*Trace, error) {
 	var (
-		rootSpanSet bool
-		children    []*Trace
+		roots    []rootSpan
+		children []*Trace
+		times    = make(map[ID]time.Time, len(series)) // Children spans time.
 	)
 
-	// Iterate over series(spans) to set `trace` fields.
-	for _, s := range result.Series {
-		var isRootSpan bool
-		span, err := newSpanFromRow(&s)
+	// Iterate over series(spans) to find the root spans & children spans.
+	for _, s := range series {
+		span, err := newSpanFromRow(&s, in.idEncoding)
 		if err != nil {
 			return nil, err
 		}
-		if span.ID.IsRoot() && rootSpanSet {
-			return nil, errors.New("unexpected multiple root spans")
-		}
-		if span.ID.IsRoot() && !rootSpanSet {
-			isRootSpan = true
+		t, err := rowTime(&s)
+		if err != nil {
+			return nil, err
 		}
-		if isRootSpan { // root span.
-			trace.Span = *span
-			rootSpanSet = true
+		if span.ID.IsRoot() { // root span.
+			roots = append(roots, rootSpan{span: span, time: t})
 		} else { // children span.
 			children = append(children, &Trace{Span: *span})
+			times[span.ID.Span] = t
 		}
 	}
-	if err := addChildren(trace, children); err != nil {
+	var (
+		trace *Trace
+		err   error
+	)
+	if len(roots) == 0 {
+		// The root span is missing(eg. dropped by retention), so the partial trace is built beneath it's highest span.
+		trace, children = partialRoot(children, times)
+	} else if trace, err = in.rootTrace(key.id, roots); err != nil {
 		return nil, err
 	}
+	addChildren(trace, children)
+	if in.collapseClientServer {
+		collapseClientServer(trace)
+	}
+	trace.TraceIDHigh = key.hi
 	return trace, nil
 }
 
 func (in *InfluxDBStore) Traces() ([]*Trace, error) {
+	return in.TracesContext(context.Background())
+}
+
+// TracesContext is like Traces, but the queries it performs are aborted once
+// `ctx` is cancelled or its deadline passes.
+func (in *InfluxDBStore) TracesContext(ctx context.Context) ([]*Trace, error) {
+	var (
+		traces []*Trace
+		err    error
+	)
+	if in.queryLanguage == Flux {
+		traces, err = in.fluxTraces(ctx, time.Time{}, time.Time{})
+	} else {
+		traces, err = in.traces(ctx, rootsFilter{})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("appdash influxdb: querying traces: %w", err)
+	}
+	return traces, nil
+}
+
+// TracesInRange is like Traces, but only returns the traces whose root span time(ie. the time of it's
+// first point, see roots) is within `start` & `end`(inclusive). A zero `start` or `end` means unbounded
+// on that side.
+func (in *InfluxDBStore) TracesInRange(start, end time.Time) ([]*Trace, error) {
+	var (
+		traces []*Trace
+		err    error
+	)
+	if in.queryLanguage == Flux {
+		traces, err = in.fluxTraces(context.Background(), start, end)
+	} else {
+		traces, err = in.traces(context.Background(), rootsFilter{start: start, end: end})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("appdash influxdb: querying traces: %w", err)
+	}
+	return traces, nil
+}
+
+// traces returns the root traces(including it's children) selected by `f`(see rootIDs), sorted by root
+// span time(newest first).
+func (in *InfluxDBStore) traces(ctx context.Context, f rootsFilter) ([]*Trace, error) {
 	traces := make([]*Trace, 0)
 
-	// GROUP BY * -> meaning group by all tags(trace_id, span_id & parent_id)
-	// grouping by all tags includes those and it's values on the query response.
-	rootSpansQuery := fmt.Sprintf("SELECT * FROM spans WHERE parent_id='%s' GROUP BY * LIMIT %d", zeroID, in.tracesPerPage)
-	rootSpansResult, err := in.executeOneQuery(rootSpansQuery)
+	// Looks up the trace IDs only, the complete traces(root spans & children) are then fetched at once.
+	ids, err := in.rootIDs(ctx, f)
 	if err != nil {
 		return nil, err
 	}
-
-	// result.Series -> A slice containing all the spans.
-	if len(rootSpansResult.Series) == 0 {
+	if len(ids) == 0 {
 		return traces, nil
 	}
+	spans, truncated, err := in.traceSpans(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := in.tracesFromSeries(spans)
+	if err != nil {
+		return nil, err
+	}
+
+	// Newest traces first, so the traces list is stable.
+	sort.Sort(tracesCursorsByTime(roots))
+	for _, root := range roots {
+		root.trace.Truncated = truncated // It's unknown which traces lost spans.
+		traces = append(traces, root.trace)
+	}
+	return traces, nil
+}
+
+// traceSpans returns the spans of the traces `ids` merged(see mergeSeries), and true if spans were
+// left out(see querySpans). They're fetched with a single query, unless `in.tracesQueryConcurrency`
+// is set: then each trace is fetched with it's own query, running up to `in.tracesQueryConcurrency`
+// of them concurrently. The first failing query cancels the rest, it's error is returned.
+func (in *InfluxDBStore) traceSpans(ctx context.Context, ids []ID) ([]influxDBModels.Row, bool, error) {
+	if in.tracesQueryConcurrency <= 0 || len(ids) == 1 {
+		q := fmt.Sprintf("SELECT * FROM %s WHERE %s GROUP BY *", quoteIdent(in.measurement), in.traceIDsCondition(ids))
+		return in.querySpans(ctx, q)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		spans     = make([][]influxDBModels.Row, len(ids)) // Spans of each trace, by index of `ids`.
+		truncated = make([]bool, len(ids))
+		next      = make(chan int) // Indexes of `ids` to be fetched.
+		wg        sync.WaitGroup
+		errOnce   sync.Once
+		firstErr  error
+	)
+	workers := in.tracesQueryConcurrency
+	if workers > len(ids) {
+		workers = len(ids)
+	}
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				q := fmt.Sprintf("SELECT * FROM %s WHERE %s GROUP BY *", quoteIdent(in.measurement), in.traceIDsCondition(ids[i:i+1]))
+				var err error
+				if spans[i], truncated[i], err = in.querySpans(ctx, q); err != nil {
+					errOnce.Do(func() { firstErr = err })
+					cancel()
+				}
+			}
+		}()
+	}
+feed:
+	for i := range ids {
+		select {
+		case next <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, false, firstErr
+	}
+	if err := ctx.Err(); err != nil { // Cancelled before all the queries were sent.
+		return nil, false, err
+	}
+	var (
+		all          []influxDBModels.Row
+		anyTruncated bool
+	)
+	for i := range ids {
+		all = append(all, spans[i]...)
+		anyTruncated = anyTruncated || truncated[i]
+	}
+	return all, anyTruncated, nil
+}
 
-	// Cache to keep track of traces to be returned.
-	tracesCache := make(map[ID]*Trace, 0)
+// rootIDs returns the IDs of up to `in.tracesPerPage` traces selected by `f`(whose limit is ignored),
+// newest root span first, see roots.
+func (in *InfluxDBStore) rootIDs(ctx context.Context, f rootsFilter) ([]ID, error) {
+	f.limit = in.tracesPerPage
+	roots, _, err := in.roots(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]ID, 0, len(roots))
+	for _, root := range roots {
+		ids = append(ids, root.Trace)
+	}
+	return ids, nil
+}
+
+// TracesWithAnnotation returns the traces(including all it's spans) which contain at least one
+// span annotated with `key` set to `value`. Filtering by indexed annotations(see
+// InfluxDBStoreConfig.IndexedAnnotations) is efficient, otherwise it requires a full scan.
+func (in *InfluxDBStore) TracesWithAnnotation(key, value string) ([]*Trace, error) {
+	encoded := encodeAnnotationValue([]byte(value))
+	if err := checkQuotable(key, encoded); err != nil {
+		return nil, fmt.Errorf("appdash influxdb: querying traces with annotation %s: %w", key, err)
+	}
+	traces, err := in.tracesWhere(context.Background(), fmt.Sprintf("%s=%s", quoteIdent(key), quoteTag(encoded)))
+	if err != nil {
+		return nil, fmt.Errorf("appdash influxdb: querying traces with annotation %s: %w", key, err)
+	}
+	return traces, nil
+}
+
+// TracesByTag returns the traces(including all it's spans) whose root span is tagged with `tag` set to
+// `value`, like Traces. `tag` must be a label(see InfluxDBStoreConfig.Labels) or an indexed annotation
+// (see InfluxDBStoreConfig.IndexedAnnotations), filtering by other annotations requires a full scan(see
+// TracesWithAnnotation).
+func (in *InfluxDBStore) TracesByTag(tag, value string) ([]*Trace, error) {
+	_, label := in.labels[tag]
+	_, indexed := in.indexedAnnotations[tag]
+	if !label && !indexed {
+		return nil, fmt.Errorf("appdash influxdb: %q is not a label nor an indexed annotation, see InfluxDBStoreConfig.IndexedAnnotations", tag)
+	}
+	encoded := encodeAnnotationValue([]byte(value))
+	if err := checkQuotable(encoded); err != nil {
+		return nil, fmt.Errorf("appdash influxdb: querying traces by tag %s: %w", tag, err)
+	}
+	condition := fmt.Sprintf("%s::tag=%s", quoteIdent(tag), quoteTag(encoded))
+	traces, err := in.traces(context.Background(), rootsFilter{where: []string{condition}})
+	if err != nil {
+		return nil, fmt.Errorf("appdash influxdb: querying traces by tag %s: %w", tag, err)
+	}
+	return traces, nil
+}
 
-	// Iterate over series(spans) to create root traces.
-	for _, s := range rootSpansResult.Series {
-		span, err := newSpanFromRow(&s)
+// SearchTraces returns the traces(including all it's spans) which contain at least one span
+// annotated with `key` set to a value matching `pattern`, a regular expression(eg. "/api/.*" for
+// URLs containing "/api/"). Patterns are unanchored & use the RE2 syntax, as InfluxDB does.
+// Binary annotation values(see encodeAnnotationValue) are matched in their stored form.
+func (in *InfluxDBStore) SearchTraces(key string, pattern string) ([]*Trace, error) {
+	if _, err := regexp.Compile(pattern); err != nil {
+		return nil, fmt.Errorf("appdash influxdb: invalid search pattern %q: %w", pattern, err)
+	}
+	if err := checkQuotable(key, pattern); err != nil {
+		return nil, fmt.Errorf("appdash influxdb: searching traces with annotation %s: %w", key, err)
+	}
+	traces, err := in.tracesWhere(context.Background(), fmt.Sprintf("%s=~%s", quoteIdent(key), quoteRegex(pattern)))
+	if err != nil {
+		return nil, fmt.Errorf("appdash influxdb: searching traces with annotation %s: %w", key, err)
+	}
+	return traces, nil
+}
+
+// tracesWhere returns the traces(including all it's spans) which contain at least one span matched by
+// `condition`(the "where" part of the query), in the order their matching spans are found.
+func (in *InfluxDBStore) tracesWhere(ctx context.Context, condition string) ([]*Trace, error) {
+	// Finds the matching spans, which may be children spans, to collect their trace IDs.
+	q := fmt.Sprintf("SELECT * FROM %s WHERE %s GROUP BY *", quoteIdent(in.measurement), condition)
+	result, err := in.executeOneQuery(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		ids  []ID
+		seen = make(map[ID]struct{}, len(result.Series))
+	)
+	for _, s := range result.Series {
+		traceID, err := in.idEncoding.parse(s.Tags["trace_id"])
 		if err != nil {
 			return nil, err
 		}
-		_, present := tracesCache[span.ID.Trace]
-		if !present {
-			tracesCache[span.ID.Trace] = &Trace{Span: *span}
-		} else {
-			return nil, errors.New("duplicated root span")
+		if _, present := seen[traceID]; !present {
+			seen[traceID] = struct{}{}
+			ids = append(ids, traceID)
+		}
+	}
+	byID, err := in.tracesByIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	traces := make([]*Trace, 0, len(byID))
+	for _, id := range ids {
+		if trace, present := byID[id]; present {
+			traces = append(traces, trace)
 		}
 	}
+	return traces, nil
+}
 
-	// Using 'OR' since 'IN' not supported yet.
-	where := `WHERE `
-	var i int = 1
-	for _, trace := range tracesCache {
-		where += fmt.Sprintf("(trace_id='%s' AND parent_id!='%s')", trace.Span.ID.Trace, zeroID)
+// TracesByIDs returns the complete traces(root span & children) of the given trace IDs, fetched
+// within a single query. Traces not found are absent from the returned map.
+func (in *InfluxDBStore) TracesByIDs(ids []ID) (map[ID]*Trace, error) {
+	traces, err := in.tracesByIDs(context.Background(), ids)
+	if err != nil {
+		return nil, fmt.Errorf("appdash influxdb: querying traces by IDs: %w", err)
+	}
+	return traces, nil
+}
 
-		// Adds 'OR' except for last iteration.
-		if i != len(tracesCache) && len(tracesCache) > 1 {
-			where += " OR "
+// tracesByIDs is like TracesByIDs, but the query it performs is aborted once `ctx` is cancelled.
+func (in *InfluxDBStore) tracesByIDs(ctx context.Context, ids []ID) (map[ID]*Trace, error) {
+	traces := make(map[ID]*Trace, len(ids))
+	if len(ids) == 0 {
+		return traces, nil
+	}
+	q := fmt.Sprintf("SELECT * FROM %s WHERE %s GROUP BY *", quoteIdent(in.measurement), in.traceIDsCondition(ids))
+	spans, truncated, err := in.querySpans(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := in.tracesFromSeries(spans)
+	if err != nil {
+		return nil, err
+	}
+	for _, root := range roots {
+		if t, present := traces[root.Trace]; present && t.TraceIDHigh < root.hi {
+			continue // Like Trace, see Trace128.
 		}
-		i += 1
+		root.trace.Truncated = truncated // It's unknown which traces lost spans.
+		traces[root.Trace] = root.trace
 	}
+	return traces, nil
+}
 
-	// Queries for all children spans of the root traces.
-	childrenSpansQuery := fmt.Sprintf("SELECT * FROM spans %s GROUP BY *", where)
-	childrenSpansResult, err := in.executeOneQuery(childrenSpansQuery)
+// tracesFromSeries returns the traces built from `spans`, the spans of one or more traces(see
+// mergeSeries), along with the time of their root span(the earliest one if there are many, or
+// the earliest span if it's missing) to sort them.
+func (in *InfluxDBStore) tracesFromSeries(spans []influxDBModels.Row) ([]*tracesCursor, error) {
+	// Groups the series(spans) by trace, to build each trace tree.
+	var (
+		roots  []*tracesCursor
+		series = make(map[traceKey][]influxDBModels.Row)
+	)
+	for _, s := range spans {
+		key, err := rowTraceKey(&s, in.idEncoding)
+		if err != nil {
+			return nil, err
+		}
+		if _, present := series[key]; !present {
+			roots = append(roots, &tracesCursor{Trace: key.id, hi: key.hi})
+		}
+		series[key] = append(series[key], s)
+	}
+	for _, root := range roots {
+		key := traceKey{hi: root.hi, id: root.Trace}
+		trace, err := in.traceFromSeries(key, series[key])
+		if err != nil {
+			return nil, err
+		}
+		root.trace = trace
+		var rootTime, spanTime time.Time
+		for _, s := range series[key] {
+			t, err := rowTime(&s)
+			if err != nil {
+				return nil, err
+			}
+			if spanTime.IsZero() || t.Before(spanTime) {
+				spanTime = t
+			}
+			if s.Tags["parent_id"] == in.idEncoding.zero() && (rootTime.IsZero() || t.Before(rootTime)) {
+				rootTime = t
+			}
+		}
+		root.Time = rootTime
+		if root.Time.IsZero() {
+			root.Time = spanTime
+		}
+	}
+	return roots, nil
+}
+
+// SlowestSpans returns up to `limit` spans which took at least `min`, slowest first. The duration
+// of a span is computed from it's timespan events, spans without them are never returned.
+func (in *InfluxDBStore) SlowestSpans(min time.Duration, limit int) ([]*Span, error) {
+	ctx := context.Background()
+	q := fmt.Sprintf("SELECT * FROM %s WHERE %s >= %d GROUP BY *", quoteIdent(in.measurement), durationFieldName, int64(min))
+	result, err := in.executeOneQuery(ctx, q)
 	if err != nil {
+		return nil, fmt.Errorf("appdash influxdb: querying slowest spans: %w", err)
+	}
+	if result.Series, err = mergeSeries(result.Series); err != nil {
 		return nil, err
 	}
 
-	children := make(map[ID][]*Trace, 0)
-	// Iterate over series(children spans) to set sub-traces to it's corresponding root trace.
-	for _, s := range childrenSpansResult.Series {
-		span, err := newSpanFromRow(&s)
+	// InfluxQL only supports ordering by time, so spans are sorted by duration here.
+	spans := make(spansByDuration, 0, len(result.Series))
+	for _, s := range result.Series {
+		span, err := newSpanFromRow(&s, in.idEncoding)
 		if err != nil {
 			return nil, err
 		}
-		trace, present := tracesCache[span.ID.Trace]
-		if !present { // Root trace not added.
-			return nil, errors.New("parent not found")
-		} else { // Root trace already added, append `child` to `children` for later usage.
-			child := &Trace{Span: *span}
-			t, found := children[trace.ID.Trace]
-			if !found {
-				children[trace.ID.Trace] = []*Trace{child}
-			} else {
-				children[trace.ID.Trace] = append(t, child)
-			}
+		d, err := rowDuration(&s)
+		if err != nil {
+			return nil, err
 		}
+		spans = append(spans, spanDurationPair{span: span, duration: d})
 	}
-	for _, trace := range tracesCache {
-		traceChildren, present := children[trace.ID.Trace]
-		if present {
-			if err := addChildren(trace, traceChildren); err != nil {
-				return nil, err
+	sort.Stable(sort.Reverse(spans))
+	if limit > 0 && len(spans) > limit {
+		spans = spans[:limit]
+	}
+	if len(spans) == 0 {
+		return []*Span{}, nil
+	}
+
+	// Only the points with a duration were matched, so the spans are queried again to get all
+	// their annotations.
+	where := make([]string, 0, len(spans))
+	for _, s := range spans {
+		where = append(where, fmt.Sprintf("(trace_id=%s AND span_id=%s)", quoteTag(in.idEncoding.format(s.span.ID.Trace)), quoteTag(in.idEncoding.format(s.span.ID.Span))))
+	}
+	q = fmt.Sprintf("SELECT * FROM %s WHERE %s GROUP BY *", quoteIdent(in.measurement), strings.Join(where, " OR "))
+	result, err = in.executeOneQuery(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("appdash influxdb: querying slowest spans: %w", err)
+	}
+	if result.Series, err = mergeSeries(result.Series); err != nil {
+		return nil, err
+	}
+	full := make(map[SpanID]*Span, len(result.Series))
+	for _, s := range result.Series {
+		span, err := newSpanFromRow(&s, in.idEncoding)
+		if err != nil {
+			return nil, err
+		}
+		full[span.ID] = span
+	}
+	slowest := make([]*Span, 0, len(spans))
+	for _, s := range spans {
+		if span, found := full[s.span.ID]; found {
+			slowest = append(slowest, span)
+		}
+	}
+	return slowest, nil
+}
+
+// TracesPageOpts contains options for InfluxDBStore.TracesPage.
+type TracesPageOpts struct {
+	Limit  int    // Maximum number of traces to be returned, if zero the default number of traces per page is used.
+	Cursor string // Opaque cursor returned by a previous TracesPage call, empty to start from the first page.
+}
+
+// TracesPage returns a page of traces(newest first) and the cursor to be used to fetch the next page,
+// which is empty once all traces were returned.
+//
+// The cursor is encoded from the time & trace ID of the last root span within the page, so pagination
+// is stable under concurrent writes: new traces never shift the position of older ones.
+func (in *InfluxDBStore) TracesPage(opts TracesPageOpts) ([]*Trace, string, error) {
+	f := rootsFilter{limit: opts.Limit}
+	if opts.Cursor != "" {
+		c, err := decodeTracesCursor(opts.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		f.after = c
+	}
+	roots, more, err := in.tracesPage(context.Background(), f)
+	if err != nil {
+		return nil, "", err
+	}
+	var next string
+	if more {
+		next = roots[len(roots)-1].encode()
+	}
+	return cursorsTraces(roots), next, nil
+}
+
+// TracesKey is the position of a trace on the traces list(see TracesBefore): it's root span time, then
+// it's trace ID for traces sharing such time.
+type TracesKey struct {
+	Time  time.Time // Root span time.
+	Trace ID        // Trace ID.
+}
+
+// TracesBefore returns up to `limit` traces(newest first) going after `before` on the traces list, and
+// the key of the oldest one, to be used as `before` to fetch the next page. It's zero once all traces
+// were returned. A zero `before` starts from the newest trace, a zero `limit` means the default number
+// of traces per page.
+//
+// Like TracesPage, it's stable under concurrent writes: new traces are newer than any returned trace,
+// so they never shift older ones. Traces sharing a root span time(eg. collected by separate stores
+// sharing the database) are sorted by trace ID, so none of them is skipped across pages.
+func (in *InfluxDBStore) TracesBefore(before TracesKey, limit int) ([]*Trace, TracesKey, error) {
+	f := rootsFilter{limit: limit}
+	if !before.Time.IsZero() {
+		f.after = &tracesCursor{Time: before.Time, Trace: before.Trace}
+	}
+	roots, more, err := in.tracesPage(context.Background(), f)
+	if err != nil {
+		return nil, TracesKey{}, fmt.Errorf("appdash influxdb: querying traces: %w", err)
+	}
+	var next TracesKey
+	if more {
+		oldest := roots[len(roots)-1]
+		next = TracesKey{Time: oldest.Time, Trace: oldest.Trace}
+	}
+	return cursorsTraces(roots), next, nil
+}
+
+// tracesPage returns up to `f.limit`(the default number of traces per page if zero) root traces(newest
+// first, including their children) selected by `f`(see roots), and whether there are more of them.
+func (in *InfluxDBStore) tracesPage(ctx context.Context, f rootsFilter) ([]*tracesCursor, bool, error) {
+	if f.limit <= 0 {
+		f.limit = in.tracesPerPage
+	}
+	roots, more, err := in.roots(ctx, f)
+	if err != nil {
+		return nil, false, err
+	}
+	if roots, err = in.rootsTraces(ctx, roots); err != nil {
+		return nil, false, err
+	}
+	return roots, more, nil
+}
+
+// rootsTraces sets the traces(including their children) of `roots`, which are returned in order without
+// those not found(eg. deleted since they were looked up).
+func (in *InfluxDBStore) rootsTraces(ctx context.Context, roots []*tracesCursor) ([]*tracesCursor, error) {
+	if len(roots) == 0 {
+		return nil, nil
+	}
+
+	// The traces are selected by the first point of their root span, but all their points are fetched
+	// to merge them(see mergeSeries), along with their children.
+	ids := make([]ID, 0, len(roots))
+	for _, root := range roots {
+		ids = append(ids, root.Trace)
+	}
+	spans, truncated, err := in.traceSpans(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	built, err := in.tracesFromSeries(spans)
+	if err != nil {
+		return nil, err
+	}
+	traces := make(map[traceKey]*Trace, len(built))
+	for _, b := range built {
+		b.trace.Truncated = truncated // It's unknown which traces lost spans.
+		traces[traceKey{hi: b.hi, id: b.Trace}] = b.trace
+	}
+	page := make([]*tracesCursor, 0, len(roots))
+	for _, root := range roots {
+		if root.trace = traces[traceKey{hi: root.hi, id: root.Trace}]; root.trace != nil { // Unless deleted since.
+			page = append(page, root)
+		}
+	}
+	return page, nil
+}
+
+// cursorsTraces returns the traces of `roots`, in order.
+func cursorsTraces(roots []*tracesCursor) []*Trace {
+	traces := make([]*Trace, 0, len(roots))
+	for _, root := range roots {
+		traces = append(traces, root.trace)
+	}
+	return traces
+}
+
+// traceIDsCondition returns a query condition matching the spans of any of the given traces.
+func (in *InfluxDBStore) traceIDsCondition(ids []ID) string {
+	return in.idsCondition("trace_id", ids)
+}
+
+// idsCondition returns a query condition matching the spans whose `tag` is any of the given IDs.
+//
+// InfluxQL does not support 'IN', so a single regular expression is used(eg. trace_id=~/^(a|b)$/),
+// which is much shorter & cheaper to plan than one comparison per ID joined by 'OR'. Servers
+// which do not support regular expressions on tags get the 'OR' based condition.
+func (in *InfluxDBStore) idsCondition(tag string, ids []ID) string {
+	sorted := make([]ID, len(ids))
+	copy(sorted, ids)
+	sort.Sort(byID(sorted))
+	values := make([]string, 0, len(sorted))
+	for _, id := range sorted {
+		if in.tagRegexps {
+			values = append(values, in.idEncoding.format(id)) // Hex or decimal digits, no regexp meta characters.
+		} else {
+			values = append(values, fmt.Sprintf("%s=%s", tag, quoteTag(in.idEncoding.format(id))))
+		}
+	}
+	if in.tagRegexps {
+		return fmt.Sprintf("%s=~/^(%s)$/", tag, strings.Join(values, "|"))
+	}
+	return fmt.Sprintf("(%s)", strings.Join(values, " OR "))
+}
+
+// Ping checks the connection to the InfluxDB server is live without writing any data, it's
+// intended to be used as a readiness probe. Returns the round-trip latency & the server version.
+func (in *InfluxDBStore) Ping() (time.Duration, string, error) {
+	con := in.conn()
+	rtt, version, err := con.Ping(context.Background())
+	if err != nil {
+		return 0, "", fmt.Errorf("appdash influxdb: ping %s: %w", con.url.Host, err)
+	}
+	return rtt, version, nil
+}
+
+// influxDBModulePath is the module of the embedded server, see ServerVersion.
+const influxDBModulePath = "github.com/influxdata/influxdb"
+
+// ServerVersion returns the version of the InfluxDB server. For the embedded server it's the version
+// set on InfluxDBStoreConfig.BuildInfo or, if unset, the version of the InfluxDB module the binary is
+// built with; for an external server it's the version reported by Ping.
+func (in *InfluxDBStore) ServerVersion() (string, error) {
+	if in.server != nil {
+		if in.buildInfo != nil && in.buildInfo.Version != "" {
+			return in.buildInfo.Version, nil
+		}
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, dep := range info.Deps {
+				if dep.Path == influxDBModulePath {
+					return dep.Version, nil
+				}
 			}
 		}
-		traces = append(traces, trace)
+		return "", errors.New("appdash influxdb: unknown embedded server version")
 	}
-	return traces, nil
+	_, version, err := in.Ping()
+	if err != nil {
+		return "", err
+	}
+	if version == "" {
+		return "", errors.New("appdash influxdb: server version not reported")
+	}
+	return version, nil
 }
 
+// Delete implements the DeleteStore interface by dropping all the spans series
+// which belong to the given traces. Traces that do not exist are ignored.
+func (in *InfluxDBStore) Delete(traces ...ID) error {
+	return in.deleteTraces(context.Background(), traces)
+}
+
+// deleteTraces is like Delete, but the statement is aborted once `ctx` is done.
+func (in *InfluxDBStore) deleteTraces(ctx context.Context, traces []ID) error {
+	if len(traces) == 0 {
+		return nil
+	}
+
+	// All traces are deleted within a single statement, eg:
+	// DROP SERIES FROM spans WHERE trace_id='a' OR trace_id='b'
+	where := make([]string, 0, len(traces))
+	for _, id := range traces {
+		where = append(where, fmt.Sprintf("trace_id=%s", quoteTag(in.idEncoding.format(id))))
+	}
+	q := fmt.Sprintf("DROP SERIES FROM %s WHERE %s", quoteIdent(in.measurement), strings.Join(where, " OR "))
+	_, err := in.executeOneStatement(ctx, q)
+	in.traceCache.remove(traces...)
+	in.collected.purge() // Deleted spans must be written once re-collected.
+	if err != nil {
+		return &InfluxDBDeleteError{Traces: traces, Err: err}
+	}
+	return nil
+}
+
+// Close writes the buffered spans, stops the background goroutines(retention cleanups & periodic
+// flushes), closes the connection and stops the embedded server(if any). Calls after the first one
+// are no-ops, returning the first call's error.
 func (in *InfluxDBStore) Close() error {
-	return in.server.Close()
+	in.closeOnce.Do(func() {
+		in.closeErr = in.close()
+	})
+	return in.closeErr
+}
+
+// close is like Close, but it must be called once.
+func (in *InfluxDBStore) close() error {
+	in.stopCleanup()
+	if in.flushStop != nil {
+		close(in.flushStop)
+		<-in.flushDone
+	}
+	if in.writeErrors != nil { // No more background writes.
+		close(in.writeErrors)
+	}
+
+	// The server is stopped even if buffered spans can't be written, they would be lost anyway.
+	err := in.flushBuffer(context.Background())
+	if con := in.conn(); con != nil {
+		con.Close()
+	}
+	if in.udp != nil {
+		in.udp.Close()
+	}
+	if in.server != nil { // Not connected to an external server.
+		if serverErr := in.server.Close(); err == nil {
+			err = serverErr
+		}
+	}
+	return err
 }
 
-func (in *InfluxDBStore) createDBIfNotExists() error {
-	q := fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", in.dbName)
+// createDBIfNotExists creates the database `db`, with the default retention policy(`in.defaultRP`) if set.
+func (in *InfluxDBStore) createDBIfNotExists(ctx context.Context, db string) error {
+	q := fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", db)
 
 	// If `in.defaultRP` info is provided, it's used to extend the query in order to create the database with
 	// a default retention policy.
-	if in.defaultRP.Duration != "" {
-		q = fmt.Sprintf("%s WITH DURATION %s", q, in.defaultRP.Duration)
+	if clauses := in.defaultRP.clauses(); len(clauses) > 0 {
+		q = fmt.Sprintf("%s WITH %s", q, strings.Join(clauses, " "))
 
 		// Retention policy name must be placed to the end of the query or it will be syntactically incorrect.
 		if in.defaultRP.Name != "" {
@@ -270,18 +1241,22 @@ func (in *InfluxDBStore) createDBIfNotExists() error {
 	}
 
 	// If there are no errors, query execution was successfully - either DB was created or already exists.
-	response, err := in.con.Query(influxDBClient.Query{Command: q})
+	response, err := in.query(ctx, influxDBClient.Query{Command: q})
 	if err != nil {
-		return err
+		return fmt.Errorf("appdash influxdb: creating database %s: %w", db, err)
 	}
 	if err := response.Error(); err != nil {
-		return err
+		return fmt.Errorf("appdash influxdb: creating database %s: %w", db, err)
 	}
 	return nil
 }
 
 // createAdminUserIfNotExists finds admin user(`in.adminUser`) if not found it's created.
+// Users of an external server are not managed by InfluxDBStore, so it's a no-op in such case.
 func (in *InfluxDBStore) createAdminUserIfNotExists() error {
+	if in.server == nil {
+		return nil
+	}
 	userInfo, err := in.server.MetaClient.Authenticate(in.adminUser.Username, in.adminUser.Password)
 	if err == influxDBErrors.ErrUserNotFound {
 		if _, createUserErr := in.server.MetaClient.CreateUser(in.adminUser.Username, in.adminUser.Password, true); createUserErr != nil {
@@ -297,16 +1272,134 @@ func (in *InfluxDBStore) createAdminUserIfNotExists() error {
 	return nil
 }
 
-func (in *InfluxDBStore) executeOneQuery(command string) (*influxDBClient.Result, error) {
-	response, err := in.con.Query(influxDBClient.Query{
+// createQueryUserIfNotExists finds the query user(`in.queryUser`), if not found it's created. The user
+// is granted read privileges on `in.dbName`, it's a no-op if no query user is set.
+func (in *InfluxDBStore) createQueryUserIfNotExists() error {
+	if in.queryUser.Username == "" {
+		return nil
+	}
+	result, err := in.queryOne(context.Background(), "SHOW USERS", in.query)
+	if err != nil {
+		return err
+	}
+	var found bool
+	for _, s := range result.Series {
+		for _, values := range s.Values {
+			if len(values) < 2 || values[0] != in.queryUser.Username {
+				continue
+			}
+			if admin, _ := values[1].(bool); admin { // must be non-admin user.
+				return errors.New("failed to validate InfluxDB query user type, found admin user")
+			}
+			found = true
+		}
+	}
+	if !found {
+		// Not executed by executeOneStatement, so the password is never observed by `in.metrics`. Statements
+		// are POSTed, so it's never part of the request URL either(eg. on errors, see influxDBConn.Query).
+		q := fmt.Sprintf("CREATE USER %s WITH PASSWORD %s", quoteIdent(in.queryUser.Username), quoteTag(in.queryUser.Password))
+		if _, err := in.queryOne(context.Background(), q, in.query); err != nil {
+			return err
+		}
+	}
+	return in.grantQueryUser(context.Background(), in.dbName)
+}
+
+// grantQueryUser grants the query user(`in.queryUser`) read privileges on `db`, it's a no-op if no
+// query user is set.
+func (in *InfluxDBStore) grantQueryUser(ctx context.Context, db string) error {
+	if in.queryUser.Username == "" {
+		return nil
+	}
+	q := fmt.Sprintf("GRANT READ ON %s TO %s", quoteIdent(db), quoteIdent(in.queryUser.Username))
+	_, err := in.queryOne(ctx, q, in.query)
+	return err
+}
+
+// executeOneQuery executes the read-only `command` as the query user(see InfluxDBStoreConfig.QueryUser)
+// and returns it's result. With read-your-writes, it waits for the latest writes first(see awaitWrites).
+func (in *InfluxDBStore) executeOneQuery(ctx context.Context, command string) (*influxDBClient.Result, error) {
+	in.awaitWrites(ctx)
+	return in.executeOne(ctx, command, in.readQuery)
+}
+
+// executeOneStatement is like executeOneQuery, but `command` may write(eg. deletes) so it's
+// executed as the admin user.
+func (in *InfluxDBStore) executeOneStatement(ctx context.Context, command string) (*influxDBClient.Result, error) {
+	return in.executeOne(ctx, command, in.query)
+}
+
+// executeOne executes `command` using `query`(see queryOne), observing it's metrics.
+func (in *InfluxDBStore) executeOne(ctx context.Context, command string, query func(context.Context, influxDBClient.Query) (*influxDBClient.Response, error)) (*influxDBClient.Result, error) {
+	queryCtx := ctx
+	if in.queryTimeout > 0 {
+		var cancel context.CancelFunc
+		queryCtx, cancel = context.WithTimeout(ctx, in.queryTimeout)
+		defer cancel()
+	}
+	start := time.Now()
+	result, err := in.queryOne(queryCtx, command, query)
+	if err != nil && queryCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		err = ErrQueryTimeout // Timed out by `in.queryTimeout`, rather than by `ctx`.
+	}
+	if in.metrics != nil {
+		in.metrics.ObserveQuery(command, time.Since(start), err)
+	}
+	in.stats.observeQuery(start, err)
+	if d := time.Since(start); in.slowQueryThreshold > 0 && d > in.slowQueryThreshold {
+		in.log().Printf("appdash influxdb: slow query (%s): %s", d, command)
+		if m, ok := in.metrics.(InfluxDBSlowQueryMetrics); ok {
+			m.ObserveSlowQuery(command, d)
+		}
+	}
+	return result, err
+}
+
+// querySpans executes `q`, a "GROUP BY *" query of spans, in chunks of `spansChunkSize` spans(series),
+// so spans are never lost to InfluxDB's limit of rows per response. Reading stops once at least
+// `in.maxChildren` spans are read, in which case true is returned since there may be more spans.
+// The spans are returned merged(see mergeSeries).
+func (in *InfluxDBStore) querySpans(ctx context.Context, q string) ([]influxDBModels.Row, bool, error) {
+	var (
+		series    []influxDBModels.Row
+		truncated bool
+	)
+	for offset := 0; ; offset += spansChunkSize {
+		result, err := in.executeOneQuery(ctx, fmt.Sprintf("%s SLIMIT %d SOFFSET %d", q, spansChunkSize, offset))
+		if err != nil {
+			return nil, false, err
+		}
+		series = append(series, result.Series...)
+		if len(result.Series) < spansChunkSize {
+			break
+		}
+		if len(series) >= in.maxChildren {
+			truncated = true
+			break
+		}
+	}
+	series, err := mergeSeries(series)
+	if err != nil {
+		return nil, false, err
+	}
+	return series, truncated, nil
+}
+
+// queryOne executes `command`(a single query) using `query` and returns it's result.
+func (in *InfluxDBStore) queryOne(ctx context.Context, command string, query func(context.Context, influxDBClient.Query) (*influxDBClient.Response, error)) (*influxDBClient.Result, error) {
+	db, err := in.database(ctx)
+	if err != nil {
+		return nil, err
+	}
+	response, err := query(ctx, influxDBClient.Query{
 		Command:  command,
-		Database: in.dbName,
+		Database: db,
 	})
 	if err != nil {
 		return nil, err
 	}
-	if err := response.Error(); err != nil {
-		return nil, err
+	if err := response.Error(); err != nil { // Query errors(eg. syntax errors) are permanent.
+		return nil, permanent(err)
 	}
 
 	// Expecting one result, since a single query is executed.
@@ -316,71 +1409,166 @@ func (in *InfluxDBStore) executeOneQuery(command string) (*influxDBClient.Result
 	return &response.Results[0], nil
 }
 
-func (in *InfluxDBStore) findSpanPoint(ID SpanID) (*influxDBClient.Point, error) {
-	q := fmt.Sprintf(`
-		SELECT * FROM spans WHERE trace_id='%s' AND span_id='%s' AND parent_id='%s' GROUP BY *
-	`, ID.Trace, ID.Span, ID.Parent)
-	result, err := in.executeOneQuery(q)
+// writePoints writes `pts` to `in.dbName`(or the tenant's database, see WithTenant) within a single request.
+func (in *InfluxDBStore) writePoints(ctx context.Context, pts []influxDBClient.Point) error {
+	db, err := in.database(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if len(result.Series) == 0 {
-		return nil, nil
+	bps := influxDBClient.BatchPoints{
+		Points:           pts,
+		Database:         db,
+		WriteConsistency: in.writeConsistency,
 	}
-	if len(result.Series) > 1 {
-		return nil, errors.New("unexpected multiple series")
+	if err := in.breaker.allow(time.Now()); err != nil {
+		return err
 	}
-	r := result.Series[0]
-	if len(r.Values) == 0 {
-		return nil, errors.New("unexpected empty series")
+	start := time.Now()
+
+	// The UDP listener writes to it's own database, so tenants' points are written through HTTP.
+	tenant := tenantFromContext(ctx)
+	if in.udp != nil && tenant == "" {
+		err = in.writeUDP(pts)
+	} else {
+		err = in.withReconnect(ctx, func(con *influxDBConn) error {
+			return con.Write(ctx, bps)
+		})
 	}
-	p := influxDBClient.Point{
-		Fields: make(pointFields, 0),
+	if in.metrics != nil {
+		in.metrics.ObserveWrite(len(pts), time.Since(start), err)
 	}
-	fields := r.Values[0]
-	for i, field := range fields {
-		key := r.Columns[i]
-		switch field.(type) {
-		case string:
-			// time field is set by InfluxDB not related to annotations.
-			if key == "time" {
-				t, err := time.Parse(time.RFC3339Nano, field.(string))
-				if err != nil {
-					return nil, err
-				}
-				p.Time = t
+	in.stats.observeWrite(start, err)
+	in.breaker.done(time.Now(), err)
+	if err == nil && tenant == "" {
+		in.observeWritten(pts)
+	}
+
+	// Even failed writes may have been partially performed.
+	if in.traceCache != nil {
+		ids := make([]ID, 0, len(pts))
+		for _, p := range pts {
+			if id, err := in.idEncoding.parse(p.Tags["trace_id"]); err == nil {
+				ids = append(ids, id)
 			}
-			p.Fields[key] = field.(string)
-		case nil:
-			continue
-		default:
-			return nil, fmt.Errorf("unexpected field type: %v", reflect.TypeOf(field))
 		}
+		in.traceCache.remove(ids...)
 	}
-	return &p, err
+	return err
 }
 
 func (in *InfluxDBStore) init(server *influxDBServer.Server) error {
 	in.server = server
-	url, err := url.Parse(fmt.Sprintf("http://%s:%d", influxDBClient.DefaultHost, influxDBClient.DefaultPort))
+	if server != nil {
+		// The configured bind address may not be the actual one(eg. ":0" binds a free port).
+		if host, port, ok := serverHTTPAddr(server); ok {
+			in.host, in.port = host, port
+		}
+	}
+	if err := in.connect(); err != nil {
+		return fmt.Errorf("appdash influxdb: connecting: %w", err)
+	}
+	if err := in.dialUDP(); err != nil {
+		return fmt.Errorf("appdash influxdb: connecting to UDP listener: %w", err)
+	}
+	if server != nil {
+		// The embedded server's HTTP API may not be listening yet right after it's opened.
+		if err := in.waitReady(in.startupTimeout); err != nil {
+			return fmt.Errorf("appdash influxdb: waiting for server: %w", err)
+		}
+	}
+	if err := in.createAdminUserIfNotExists(); err != nil {
+		return fmt.Errorf("appdash influxdb: creating admin user: %w", err)
+	}
+
+	// InfluxDB 2.x buckets are managed by the server's users, so there is no database to set up.
+	if in.token == "" {
+		if err := in.setUpDB(); err != nil {
+			return err
+		}
+		if err := in.createQueryUserIfNotExists(); err != nil {
+			return fmt.Errorf("appdash influxdb: creating query user: %w", err)
+		}
+	}
+
+	_, version, err := in.con.Ping(context.Background())
 	if err != nil {
-		return err
+		return fmt.Errorf("appdash influxdb: pinging server: %w", err)
+	}
+	in.tagRegexps = supportsTagRegexps(version)
+	in.subqueries = supportsSubqueries(version)
+	// The test database was just dropped(see setUpTestMode), so it has no spans.
+	if in.token != "" || in.mode != testMode {
+		if err := in.checkIDEncoding(); err != nil {
+			return fmt.Errorf("appdash influxdb: checking ID encoding: %w", err)
+		}
 	}
+	if in.tracesPerPage <= 0 {
+		in.tracesPerPage = defaultTracesPerPage
+	}
+	return nil
+}
 
-	// TODO: Upgrade to client v2, see: github.com/influxdata/influxdb/blob/master/client/v2/client.go
-	// We're currently using v1.
-	con, err := influxDBClient.NewClient(influxDBClient.Config{
-		URL:      *url,
-		Username: in.adminUser.Username,
-		Password: in.adminUser.Password,
-	})
+// serverHTTPAddr returns the host & port the HTTP API of the embedded `server` listens on,
+// false if it has no HTTP API(ie. HTTPD.Enabled is false).
+func serverHTTPAddr(server *influxDBServer.Server) (string, int, bool) {
+	for _, s := range server.Services {
+		httpd, ok := s.(*influxDBHTTPD.Service)
+		if !ok {
+			continue
+		}
+		addr, ok := httpd.Addr().(*net.TCPAddr)
+		if !ok {
+			continue
+		}
+		host := addr.IP.String()
+		if addr.IP == nil || addr.IP.IsUnspecified() {
+			host = influxDBClient.DefaultHost
+		}
+		return host, addr.Port, true
+	}
+	return "", 0, false
+}
+
+// supportsTagRegexps reports whether the InfluxDB server `version`(eg. "0.11.1") supports
+// regular expressions on tags, available since 0.9. Unknown versions are assumed to support them.
+func supportsTagRegexps(version string) bool {
+	major, minor, ok := parseVersion(version)
+	if !ok {
+		return true
+	}
+	return major > 0 || minor >= 9
+}
+
+// supportsSubqueries reports whether the InfluxDB server `version` supports subqueries, available
+// since 1.2. Unknown versions(eg. the embedded server's) are assumed not to support them.
+func supportsSubqueries(version string) bool {
+	major, minor, ok := parseVersion(version)
+	if !ok {
+		return false
+	}
+	return major > 1 || major == 1 && minor >= 2
+}
+
+// parseVersion returns the major & minor numbers of the InfluxDB server `version`(eg. "v2.7.1"),
+// false if it's unknown.
+func parseVersion(version string) (int, int, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(version, "v"), ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, false
+	}
+	major, err := strconv.Atoi(parts[0])
 	if err != nil {
-		return err
+		return 0, 0, false
 	}
-	in.con = con
-	if err := in.createAdminUserIfNotExists(); err != nil {
-		return err
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, false
 	}
+	return major, minor, true
+}
+
+// setUpDB sets up `in.dbName` according to `in.mode` & creates it if it does not exist.
+func (in *InfluxDBStore) setUpDB() error {
 	switch in.mode {
 	case testMode:
 		if err := in.setUpTestMode(); err != nil {
@@ -390,51 +1578,60 @@ func (in *InfluxDBStore) init(server *influxDBServer.Server) error {
 		if err := in.setUpReleaseMode(); err != nil {
 			return err
 		}
-	}
-	if err := in.createDBIfNotExists(); err != nil {
-		return err
-	}
-
-	// TODO: let lib users decide `in.tracesPerPage` through InfluxDBStoreConfig.
-	in.tracesPerPage = defaultTracesPerPage
-	return nil
+	}
+	return in.createDBIfNotExists(context.Background(), in.dbName)
 }
 
 func (in *InfluxDBStore) setUpReleaseMode() error {
-	in.dbName = releaseDBName
+	if in.dbName == "" {
+		in.dbName = releaseDBName
+	}
 	return nil
 }
 
 func (in *InfluxDBStore) setUpTestMode() error {
-	in.dbName = testDBName
-	response, err := in.con.Query(influxDBClient.Query{
-		Command: fmt.Sprintf("DROP DATABASE IF EXISTS %s", testDBName),
+	if in.dbName == "" {
+		in.dbName = testDBName
+	}
+
+	// The test database is dropped, so it must never be the release one.
+	if in.dbName == releaseDBName {
+		return fmt.Errorf("appdash influxdb: refusing to use the release database %q in test mode", in.dbName)
+	}
+	return in.dropDB(context.Background(), in.dbName)
+}
+
+// dropDB drops the database `db`, if it exists.
+func (in *InfluxDBStore) dropDB(ctx context.Context, db string) error {
+	response, err := in.query(ctx, influxDBClient.Query{
+		Command: fmt.Sprintf("DROP DATABASE IF EXISTS %s", db),
 	})
 	if err != nil {
-		return err
+		return fmt.Errorf("appdash influxdb: dropping database %s: %w", db, err)
 	}
 	if err := response.Error(); err != nil {
-		return err
+		return fmt.Errorf("appdash influxdb: dropping database %s: %w", db, err)
 	}
 	return nil
 }
 
-func annotationsFromEvents(a Annotations) (Annotations, error) {
+// annotationsFromEvents returns the annotations of the events found on `a`, along with such events.
+func annotationsFromEvents(a Annotations) (Annotations, []Event, error) {
 	var (
 		annotations Annotations
 		events      []Event
 	)
 	if err := UnmarshalEvents(a, &events); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	for _, e := range events {
 		anns, err := MarshalEvent(e)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		annotations = append(annotations, anns...)
 	}
-	return annotations, nil
+	return annotations, events, nil
 }
 
 func annotationsFromRow(r *influxDBModels.Row) (*Annotations, error) {
@@ -458,7 +1655,11 @@ func annotationsFromRow(r *influxDBModels.Row) (*Annotations, error) {
 		var value []byte
 		switch field.(type) {
 		case string:
-			value = []byte(field.(string))
+			value = decodeAnnotationValue(field.(string))
+		case json.Number:
+			// Numeric fields are set by InfluxDBStore(eg. `durationFieldName`), they're dropped along with
+			// the other annotations not belonging to any event(see annotationsFromEvents).
+			value = []byte(field.(json.Number).String())
 		case nil:
 		default:
 			return nil, fmt.Errorf("unexpected field type: %v", reflect.TypeOf(field))
@@ -473,16 +1674,6 @@ func annotationsFromRow(r *influxDBModels.Row) (*Annotations, error) {
 	return &annotations, nil
 }
 
-// extendFields replaces existing items on dst from src.
-func extendFields(dst, src pointFields) pointFields {
-	for k, v := range src {
-		if _, present := dst[k]; present {
-			dst[k] = v
-		}
-	}
-	return dst
-}
-
 // filterSchemas returns `Annotations` which contains items taken from `anns`.
 // Some items from `anns` won't be included(those which were not saved by `InfluxDBStore.Collect(...)`).
 func filterSchemas(anns []Annotation) Annotations {
@@ -493,7 +1684,8 @@ func filterSchemas(anns []Annotation) Annotations {
 
 	// Converts `schemasAnn.Value` into slice of strings, each item is a schema.
 	// Eg. schemas := []string{"HTTPClient", "HTTPServer"}
-	schemas := strings.Split(string(schemasAnn.Value), schemasFieldSeparator)
+	// An invalid schemas field is handled as an empty one, so only non-schema annotations are included.
+	schemas, _ := parseSchemasField(string(schemasAnn.Value))
 
 	// Iterates over `anns` to check if each annotation should be included or not to the `annotations` be returned.
 	for _, a := range anns {
@@ -537,30 +1729,10 @@ func findSchemasAnnotation(anns []Annotation) *Annotation {
 	return nil
 }
 
-// findTraceParent walks through `rootTrace` to look for `child`; once found — it's trace parent is returned.
-func findTraceParent(root, child *Trace) *Trace {
-	var walkToParent func(root, child *Trace) *Trace
-	walkToParent = func(root, child *Trace) *Trace {
-		if root.ID.Span == child.ID.Parent {
-			return root
-		}
-		for _, sub := range root.Sub {
-			if sub.ID.Span == child.ID.Parent {
-				return sub
-			}
-			if r := walkToParent(sub, child); r != nil {
-				return r
-			}
-		}
-		return nil
-	}
-	return walkToParent(root, child)
-}
-
-// mergeSchemasField merges new and old which are a set of schemas(strings) separated by `schemasFieldSeparator`.
+// mergeSchemasField merges new and old which are a set of schemas(strings), see parseSchemasField.
 // Returns the result of merging new & old without duplications.
 func mergeSchemasField(new, old interface{}) (string, error) {
-	// Since new and old have the same data structures(a set of strings separated by `schemasFieldSeparator`).
+	// Since new and old have the same data structures(a set of schemas).
 	// So same logic is applied to both.
 	fields := []interface{}{new, old}
 	var strFields []string
@@ -578,32 +1750,27 @@ func mergeSchemasField(new, old interface{}) (string, error) {
 	}
 
 	// Schemas cache, used to keep track schemas to be returned(without duplications).
-	schemas := make(map[string]string, 0)
+	schemas := make(map[string]struct{}, 0)
+	var result []string
 
 	// Iterates over `strFields` to convert each into a slice([]string), then iterates over it in order to
-	// add each to `schemas` if not present already.
+	// add each to `result` if not present already.
 	for _, strField := range strFields {
-		if strField == "" {
-			continue
+		sf, err := parseSchemasField(strField)
+		if err != nil {
+			return "", err
 		}
-		sf := strings.Split(strField, schemasFieldSeparator)
 		for _, s := range sf {
 			if _, found := schemas[s]; !found {
-				schemas[s] = s
+				schemas[s] = struct{}{}
+				result = append(result, s)
 			}
 		}
 	}
-
-	var result []string
-	for k, _ := range schemas {
-		result = append(result, k)
-	}
-
-	// Returns a string which contains all the schemas separated by `schemasFieldSeparator`.
-	return strings.Join(result, schemasFieldSeparator), nil
+	return formatSchemasField(result), nil
 }
 
-// schemasFromAnnotations returns a string(a set of schemas(strings) separated by `schemasFieldSeparator`) - eg. "HTTPClient,HTTPServer,name".
+// schemasFromAnnotations returns the schemas field(see formatSchemasField) - eg. `["HTTPClient","HTTPServer","name"]`.
 // Each schema is extracted from each `Annotation.Key` from `anns`.
 func schemasFromAnnotations(anns []Annotation) string {
 	var schemas []string
@@ -614,78 +1781,388 @@ func schemasFromAnnotations(anns []Annotation) string {
 			schemas = append(schemas, ann.Key[len(schemaPrefix):])
 		}
 	}
-	return strings.Join(schemas, schemasFieldSeparator)
+	return formatSchemasField(schemas)
+}
+
+// formatSchemasField returns `schemas` encoded as the schemas field: a JSON array, so schemas
+// may contain any character, or an empty string if there are no schemas.
+func formatSchemasField(schemas []string) string {
+	if len(schemas) == 0 {
+		return ""
+	}
+	b, err := json.Marshal(schemas)
+	if err != nil { // Can't fail for strings.
+		panic(err)
+	}
+	return string(b)
+}
+
+// parseSchemasField returns the schemas within the schemas field `f`, which is either a JSON array
+// or a set of schemas separated by `schemasFieldSeparator`(as written by previous versions).
+func parseSchemasField(f string) ([]string, error) {
+	if f == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(f, "[") {
+		return strings.Split(f, schemasFieldSeparator), nil
+	}
+	var schemas []string
+	if err := json.Unmarshal([]byte(f), &schemas); err != nil {
+		return nil, fmt.Errorf("invalid schemas field: %w", err)
+	}
+	return schemas, nil
 }
 
 // addChildren adds `children` to `root`; each child is appended to it's trace parent.
-func addChildren(root *Trace, children []*Trace) error {
-	var (
-		addFn         func() // Handles children appending to it's trace parent.
-		errMaxRetries error  = errors.New("maximum number of retries")
-		retries       int    = len(children) // Maximum number of retries to add `children` elements to `root`.
-		try           int                    // Current number of try to add `children` elements to `root`.
-	)
-	addFn = func() {
-		for i := len(children) - 1; i >= 0; i-- {
-			child := children[i]
-			t := findTraceParent(root, child)
-			if t != nil { // Trace found.
-				if t.Sub == nil { // Empty sub-traces slice.
-					t.Sub = []*Trace{child}
-				} else { // Non-empty sub-traces slice.
-					t.Sub = append(t.Sub, child)
-				}
+//
+// Every span(`root`, it's sub-traces & `children`) is indexed by span ID first, so each child
+// is attached to it's parent in a single pass regardless of the order `children` are given.
+//
+// Children whose parent is missing(eg. dropped by a retention policy) are attached to a
+// placeholder sub-trace of `root`, which has the missing parent's span ID & no annotations,
+// so the rest of the trace is still returned. Children whose parent is within their own
+// subtree(a cycle) can't be attached, they're added to `root.UnattachedSpans` instead.
+func addChildren(root *Trace, children []*Trace) {
+	spans := make(map[ID]*Trace, len(children)+1)
+	var index func(t *Trace)
+	index = func(t *Trace) {
+		spans[t.ID.Span] = t
+		for _, sub := range t.Sub {
+			index(sub)
+		}
+	}
+	index(root)
+	for _, child := range children {
+		spans[child.ID.Span] = child
+	}
+	parents := make(map[*Trace]*Trace, len(children)) // Parent of each attached child.
+	for _, child := range children {
+		parent, found := spans[child.ID.Parent]
+		switch {
+		case found && parent == child: // Its own parent, attached to `root`.
+			parent = root
+		case !found:
+			parent = &Trace{Span: Span{ID: SpanID{Trace: root.ID.Trace, Span: child.ID.Parent, Parent: root.ID.Span}}}
+			spans[child.ID.Parent] = parent
+			root.Sub = append(root.Sub, parent)
+		}
+		if isAncestor(child, parent, parents) {
+			root.UnattachedSpans = append(root.UnattachedSpans, child)
+			continue
+		}
+		parent.Sub = append(parent.Sub, child)
+		parents[child] = parent
+	}
+}
 
-				// Removes current child since was added to it's parent.
-				children = append(children[:i], children[i+1:]...)
-			}
+// isAncestor reports whether `a` is `t` or one of it's ancestors, given `parents`(trace -> parent).
+func isAncestor(a, t *Trace, parents map[*Trace]*Trace) bool {
+	for ; t != nil; t = parents[t] {
+		if t == a {
+			return true
 		}
 	}
+	return false
+}
 
-	// Loops until all `children` elements were added to it's trace parent or when maximum number of retries reached.
-	for {
-		if len(children) == 0 {
-			break
+// spanDuration returns the duration of the span with annotations `anns`, computed from it's
+// timespan events; false is returned if it has none.
+func spanDuration(anns Annotations) (time.Duration, bool) {
+	var events []Event
+	if err := UnmarshalEvents(anns, &events); err != nil {
+		return 0, false
+	}
+	start, end, ok := findTraceTimes(events)
+	if !ok || end.Before(start) {
+		return 0, false
+	}
+	return end.Sub(start), true
+}
+
+// timeRangeCondition returns an InfluxQL condition(to be appended to a "where" part) which
+// matches points between `start` & `end`; a zero `start` or `end` means unbounded on that side.
+func timeRangeCondition(start, end time.Time) string {
+	var condition string
+	if !start.IsZero() {
+		condition += fmt.Sprintf(" AND time >= '%s'", start.UTC().Format(time.RFC3339Nano))
+	}
+	if !end.IsZero() {
+		condition += fmt.Sprintf(" AND time <= '%s'", end.UTC().Format(time.RFC3339Nano))
+	}
+	return condition
+}
+
+// rowTime returns the time of the first point within `r`, as set by InfluxDB on the "time" column.
+func rowTime(r *influxDBModels.Row) (time.Time, error) {
+	if len(r.Values) == 0 {
+		return time.Time{}, errors.New("unexpected empty series")
+	}
+	for i, column := range r.Columns {
+		if column != "time" {
+			continue
 		}
-		if try == retries {
-			return errMaxRetries
+		v, ok := r.Values[0][i].(string)
+		if !ok {
+			return time.Time{}, fmt.Errorf("unexpected time field type: %v", reflect.TypeOf(r.Values[0][i]))
 		}
-		addFn()
-		try++
+		return time.Parse(time.RFC3339Nano, v)
 	}
-	return nil
+	return time.Time{}, errors.New("time column not found")
 }
 
-// withoutEmptyFields filters `pf` and returns `pointFields` excluding those that have empty values.
-func withoutEmptyFields(pf pointFields) pointFields {
-	r := make(pointFields, 0)
-	for k, v := range pf {
-		switch v.(type) {
-		case string:
-			if v.(string) == "" {
-				continue
-			}
-			r[k] = v
-		case nil:
+// rowFieldTime returns the time(Unix nanoseconds) set on the `column` field of the first point within `r`,
+// zero if unset(eg. spans collected before it was recorded).
+func rowFieldTime(r *influxDBModels.Row, column string) time.Time {
+	if len(r.Values) == 0 {
+		return time.Time{}
+	}
+	for i, c := range r.Columns {
+		if c != column {
+			continue
+		}
+		n, ok := r.Values[0][i].(json.Number)
+		if !ok {
+			return time.Time{}
+		}
+		ns, err := n.Int64()
+		if err != nil {
+			return time.Time{}
+		}
+		return time.Unix(0, ns).UTC()
+	}
+	return time.Time{}
+}
+
+// rowDuration returns the span duration of the first point within `r`, as set on the `durationFieldName` column.
+func rowDuration(r *influxDBModels.Row) (time.Duration, error) {
+	if len(r.Values) == 0 {
+		return 0, errors.New("unexpected empty series")
+	}
+	for i, column := range r.Columns {
+		if column != durationFieldName {
 			continue
+		}
+		v, ok := r.Values[0][i].(json.Number)
+		if !ok {
+			return 0, fmt.Errorf("unexpected duration field type: %v", reflect.TypeOf(r.Values[0][i]))
+		}
+		n, err := v.Int64()
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n), nil
+	}
+	return 0, errors.New("duration column not found")
+}
+
+// tracesCursor represents the position of a root trace within the traces list(sorted by time, newest first).
+type tracesCursor struct {
+	Time  time.Time // Root span time.
+	Trace ID        // Trace ID, used to sort traces with the same root span time.
+	hi    ID        // High 64 bits of the trace ID, see TraceIDHighAnnotationKey.
+	trace *Trace
+}
+
+// before reports whether `c` goes after `o` on the traces list.
+func (c *tracesCursor) before(o *tracesCursor) bool {
+	if c.Time.Equal(o.Time) {
+		return c.Trace < o.Trace
+	}
+	return c.Time.Before(o.Time)
+}
+
+// encode returns `c` as an opaque string, eg: base64("1458606437123456789:0000000000000001").
+func (c *tracesCursor) encode() string {
+	return base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%s", c.Time.UnixNano(), c.Trace)))
+}
+
+// decodeTracesCursor decodes a cursor previously encoded by `tracesCursor.encode`.
+func decodeTracesCursor(s string) (*tracesCursor, error) {
+	errInvalid := fmt.Errorf("appdash: invalid traces cursor %q", s)
+	b, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalid
+	}
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 {
+		return nil, errInvalid
+	}
+	ns, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, errInvalid
+	}
+	id, err := ParseID(parts[1])
+	if err != nil {
+		return nil, errInvalid
+	}
+	return &tracesCursor{Time: time.Unix(0, ns).UTC(), Trace: id}, nil
+}
+
+// tracesCursorsByTime sorts traces cursors by time(newest first), then by trace ID.
+type tracesCursorsByTime []*tracesCursor
+
+func (t tracesCursorsByTime) Len() int           { return len(t) }
+func (t tracesCursorsByTime) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t tracesCursorsByTime) Less(i, j int) bool { return t[j].before(t[i]) }
+
+type spanDurationPair struct {
+	span     *Span
+	duration time.Duration
+}
+
+type spansByDuration []spanDurationPair
+
+func (s spansByDuration) Len() int           { return len(s) }
+func (s spansByDuration) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s spansByDuration) Less(i, j int) bool { return s[i].duration < s[j].duration }
+
+// annotationsByKey sorts annotations by key, schema annotations(see schemaPrefix) first, then
+// by value.
+type annotationsByKey Annotations
+
+func (a annotationsByKey) Len() int      { return len(a) }
+func (a annotationsByKey) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a annotationsByKey) Less(i, j int) bool {
+	if si, sj := strings.HasPrefix(a[i].Key, schemaPrefix), strings.HasPrefix(a[j].Key, schemaPrefix); si != sj {
+		return si
+	}
+	if a[i].Key != a[j].Key {
+		return a[i].Key < a[j].Key
+	}
+	return bytes.Compare(a[i].Value, a[j].Value) < 0
+}
+
+type byID []ID
+
+func (bi byID) Len() int           { return len(bi) }
+func (bi byID) Swap(i, j int)      { bi[i], bi[j] = bi[j], bi[i] }
+func (bi byID) Less(i, j int) bool { return bi[i] < bi[j] }
+
+// encodeAnnotationValue returns the annotation value `v` as stored on InfluxDB. InfluxDB strings
+// must be valid UTF-8 without NUL characters, so other values(eg. binary payloads) are stored base64
+// encoded with `binaryValuePrefix`, as are the values starting with it, so any value round-trips.
+func encodeAnnotationValue(v []byte) string {
+	if utf8.Valid(v) && bytes.IndexByte(v, 0) == -1 && !bytes.HasPrefix(v, []byte(binaryValuePrefix)) {
+		return string(v)
+	}
+	return binaryValuePrefix + base64.StdEncoding.EncodeToString(v)
+}
+
+// decodeAnnotationValue returns the annotation value stored as `s`, see encodeAnnotationValue.
+func decodeAnnotationValue(s string) []byte {
+	if !strings.HasPrefix(s, binaryValuePrefix) {
+		return []byte(s)
+	}
+	v, err := base64.StdEncoding.DecodeString(s[len(binaryValuePrefix):])
+	if err != nil { // Not encoded by encodeAnnotationValue.
+		return []byte(s)
+	}
+	return v
+}
+
+// quoteTag returns `value` as a single-quoted InfluxQL string literal, safe to be
+// interpolated into the "where" part of a query(eg. trace_id, span_id & parent_id tags).
+// Backslashes, single quotes & newlines are escaped. Other control characters can't be
+// part of InfluxQL literals, so values which may contain them must be rejected first(see
+// checkQuotable).
+func quoteTag(value string) string {
+	return quote(value, '\'')
+}
+
+// quoteRegex returns `pattern` as an InfluxQL regular expression literal(eg. /^a$/), slashes are
+// escaped unless they already are.
+func quoteRegex(pattern string) string {
+	var b strings.Builder
+	b.WriteByte('/')
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '\\' && i+1 < len(pattern):
+			b.WriteByte(c)
+			i++
+			b.WriteByte(pattern[i])
+		case c == '/':
+			b.WriteString(`\/`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('/')
+	return b.String()
+}
+
+// quoteIdent returns `name` as a double-quoted InfluxQL identifier(eg. a measurement name),
+// escaped the same way as quoteTag.
+func quoteIdent(name string) string {
+	return quote(name, '"')
+}
+
+// quote returns `value` enclosed by `q`, escaping backslashes, `q` & newlines. Other control
+// characters are kept as is, making the query fail instead of matching another value.
+func quote(value string, q rune) string {
+	var b bytes.Buffer
+	b.WriteRune(q)
+	for _, r := range value {
+		switch {
+		case r == '\\' || r == q:
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
 		default:
-			r[k] = v
+			b.WriteRune(r)
 		}
 	}
-	return r
+	b.WriteRune(q)
+	return b.String()
+}
+
+// checkQuotable returns an error if any of `values` has control characters other than newlines,
+// which can't be quoted(see quote) & are never part of valid tag values, keys or names.
+func checkQuotable(values ...string) error {
+	for _, v := range values {
+		for _, r := range v {
+			if r != '\n' && unicode.IsControl(r) {
+				return fmt.Errorf("invalid control character %q in %q", r, v)
+			}
+		}
+	}
+	return nil
+}
+
+// newSpanFromRow returns the span of `r`, a span series whose IDs are encoded with `enc`.
+func newSpanFromRow(r *influxDBModels.Row, enc IDEncoding) (*Span, error) {
+	span, err := rawSpanFromRow(r, enc)
+	if err != nil {
+		return nil, err
+	}
+	anns, events, err := annotationsFromEvents(filterSchemas(span.Annotations))
+	if err != nil {
+		return nil, err
+	}
+	if start, end, ok := findTraceTimes(events); ok {
+		span.Start, span.End = start, end
+	}
+
+	// Columns(& so events) are returned in no particular order, but a span's annotations are
+	// always read in the same order.
+	sort.Stable(annotationsByKey(anns))
+	span.Annotations = anns
+	return span, nil
 }
 
-func newSpanFromRow(r *influxDBModels.Row) (*Span, error) {
+// rawSpanFromRow is like newSpanFromRow, but the span's annotations are all the columns(fields) &
+// indexed annotations of `r`, see GetSpanRaw.
+func rawSpanFromRow(r *influxDBModels.Row, enc IDEncoding) (*Span, error) {
 	span := &Span{}
-	traceID, err := ParseID(r.Tags["trace_id"])
+	traceID, err := enc.parse(r.Tags["trace_id"])
 	if err != nil {
 		return nil, err
 	}
-	spanID, err := ParseID(r.Tags["span_id"])
+	spanID, err := enc.parse(r.Tags["span_id"])
 	if err != nil {
 		return nil, err
 	}
-	parentID, err := ParseID(r.Tags["parent_id"])
+	parentID, err := enc.parse(r.Tags["parent_id"])
 	if err != nil {
 		return nil, err
 	}
@@ -698,17 +2175,84 @@ func newSpanFromRow(r *influxDBModels.Row) (*Span, error) {
 	if err != nil {
 		return nil, err
 	}
-	anns, err := annotationsFromEvents(filterSchemas(*annotations))
-	if err != nil {
-		return nil, err
+
+	span.FirstSeen = rowFieldTime(r, firstSeenFieldName)
+	span.LastUpdated = rowFieldTime(r, lastUpdatedFieldName)
+
+	// Tags other than trace_id, trace_id_hi, span_id & parent_id are indexed annotations.
+	span.Kind = r.Tags[kindTag]
+	var indexed []string
+	for k := range r.Tags {
+		switch k {
+		case "trace_id", traceIDHighTag, "span_id", "parent_id":
+		default:
+			indexed = append(indexed, k)
+		}
 	}
-	span.Annotations = anns
+	sort.Strings(indexed)
+	for _, k := range indexed {
+		*annotations = append(*annotations, Annotation{Key: k, Value: decodeAnnotationValue(r.Tags[k])})
+	}
+	span.Annotations = *annotations
 	return span, nil
 }
 
+// InfluxDBDeleteError is returned by InfluxDBStore.Delete when traces could not be deleted.
+type InfluxDBDeleteError struct {
+	Traces []ID // Traces which failed to be deleted.
+	Err    error
+}
+
+func (e *InfluxDBDeleteError) Error() string {
+	return fmt.Sprintf("appdash: failed to delete traces %v: %v", e.Traces, e.Err)
+}
+
+// InfluxDBMetrics observes the writes & queries performed by InfluxDBStore, eg. to export them
+// to a metrics system. Implementations must be safe for concurrent use and should return quickly,
+// since they are called on the Collect & query paths.
+type InfluxDBMetrics interface {
+	// ObserveWrite is called after writing `points` span's points, `d` is the write duration
+	// and `err` the write error, if any.
+	ObserveWrite(points int, d time.Duration, err error)
+
+	// ObserveQuery is called after executing the query `command`, `d` is the query duration
+	// and `err` the query error, if any.
+	ObserveQuery(command string, d time.Duration, err error)
+}
+
+// InfluxDBSlowQueryMetrics may be implemented by an InfluxDBMetrics to also observe the slow queries,
+// see InfluxDBStoreConfig.SlowQueryThreshold.
+type InfluxDBSlowQueryMetrics interface {
+	// ObserveSlowQuery is called after executing the query `command`, which took `d`; it's called
+	// after ObserveQuery.
+	ObserveSlowQuery(command string, d time.Duration)
+}
+
 type InfluxDBRetentionPolicy struct {
 	Name     string // Name used to indentify this retention policy.
 	Duration string // How long InfluxDB keeps the data. Eg: "1h", "1d", "1w".
+
+	// ShardGroupDuration is the time range covered by each shard group(eg. "1d"), if unset InfluxDB
+	// picks it from Duration. ReplicationFactor is the number of copies of the data kept by the
+	// cluster, 1 if unset.
+	ShardGroupDuration string
+	ReplicationFactor  int
+}
+
+// clauses returns the retention policy settings of `rp` as InfluxQL clauses(eg. "DURATION 1h
+// REPLICATION 1"), unset settings are left out.
+func (rp InfluxDBRetentionPolicy) clauses() []string {
+	var clauses []string
+	if rp.Duration != "" {
+		clauses = append(clauses, fmt.Sprintf("DURATION %s", rp.Duration))
+	}
+	if rp.ReplicationFactor > 0 {
+		clauses = append(clauses, fmt.Sprintf("REPLICATION %d", rp.ReplicationFactor))
+	}
+	if rp.ShardGroupDuration != "" {
+		clauses = append(clauses, fmt.Sprintf("SHARD DURATION %s", rp.ShardGroupDuration))
+	}
+	return clauses
 }
 
 type InfluxDBStoreConfig struct {
@@ -717,6 +2261,375 @@ type InfluxDBStoreConfig struct {
 	DefaultRP InfluxDBRetentionPolicy
 	Mode      mode
 	Server    *influxDBServer.Config
+
+	// ExternalURL is the URL of an existing InfluxDB server(eg. "http://influxdb.example.com:8086").
+	// When set, the store connects to it and no embedded server is started(`Server` & `BuildInfo` are ignored).
+	ExternalURL string
+
+	// Ignored when ExternalURL is set, or for the embedded server whose actual HTTP address is used.
+	Host string
+	Port int
+
+	// Secure makes the store connect to InfluxDB using HTTPS, with the TLS settings from TLSConfig(if nil,
+	// the default settings are used). URLs with "https" scheme on ExternalURL are always secure.
+	Secure    bool
+	TLSConfig *tls.Config
+
+	// BatchSize & FlushInterval enable write buffering: collected spans are kept in memory and written
+	// in batches, once BatchSize spans are buffered or every FlushInterval(whichever comes first).
+	// Buffered spans are written on InfluxDBStore.Close. Both zero(default) disable write buffering.
+	BatchSize     int
+	FlushInterval time.Duration
+
+	// MaxBufferedPoints caps the number of spans buffered(see BatchSize), which otherwise grows while
+	// writes fail(eg. InfluxDB is down or too slow). Once reached, collecting new spans behaves as set
+	// by BufferFullPolicy, BufferFullBlock by default. Dropped spans are counted by StoreStats.DroppedPoints.
+	// Zero(default) doesn't cap the buffer.
+	MaxBufferedPoints int
+	BufferFullPolicy  BufferFullPolicy
+
+	// CircuitBreakerThreshold enables a circuit breaker around writes: after CircuitBreakerThreshold
+	// consecutive transient write failures(eg. InfluxDB is down), it opens for CircuitBreakerCooldown
+	// (30 seconds by default) during which writes fail with ErrCircuitOpen without reaching InfluxDB.
+	// Then a single write probes InfluxDB, closing the breaker if it succeeds or opening it again if
+	// not. Zero(default) disables it.
+	CircuitBreakerThreshold int
+	CircuitBreakerCooldown  time.Duration
+
+	// WriteConsistency is the consistency level of writes on InfluxDB clusters: "any", "one", "quorum"
+	// or "all". If unset(default) the server's default is used. Ignored when using a token.
+	WriteConsistency string
+
+	// WriteProtocol is how spans are written, HTTPWriteProtocol by default. UDPWriteProtocol writes
+	// them to the InfluxDB UDP listener at UDPAddr(eg. "localhost:8089"), which must write to the
+	// store's database, for a higher throughput: it's fire & forget, lost writes are never reported
+	// as errors & written spans are only queryable once the listener flushes it's batch(ie. even
+	// after Flush returns). Queries still use the HTTP API. Not supported when using a token.
+	WriteProtocol WriteProtocol
+	UDPAddr       string
+
+	// Metrics observes the writes & queries performed by the store, if nil(default) nothing is observed.
+	Metrics InfluxDBMetrics
+
+	// Logger logs the store's notable events: slow queries, retries & reconnects to InfluxDB and
+	// retention cleanup runs(see MaxAge). If nil(default) nothing is logged.
+	Logger Logger
+
+	// SlowQueryThreshold is the duration above which queries are logged as slow(see Logger), along with
+	// their command, and observed by Metrics if it implements InfluxDBSlowQueryMetrics. Zero(default)
+	// disables it.
+	SlowQueryThreshold time.Duration
+
+	// QueryTimeout is how long each query may take(including it's retries, see MaxReconnectAttempts)
+	// before it's aborted, failing with ErrQueryTimeout. Zero(default) disables it.
+	QueryTimeout time.Duration
+
+	// MaxAge enables a background retention cleanup which deletes the traces whose spans were all
+	// collected more than MaxAge ago every CleanupInterval(one minute if unset), so traces are never
+	// left partial. Zero MaxAge(default) disables it. It complements the InfluxDB retention policy(see
+	// DefaultRP), which only drops whole shards.
+	MaxAge          time.Duration
+	CleanupInterval time.Duration
+
+	// OnTraceExpired is called with the ID of each trace deleted by the retention cleanup(see MaxAge),
+	// once it's deleted; traces are deleted whole, so it's never called for a trace with newer spans.
+	// It's called by the cleanup goroutine, which is delayed until it returns. Traces dropped by the
+	// InfluxDB retention policy(see DefaultRP) or deleted by Delete are never observed, as the store
+	// doesn't know which they are.
+	OnTraceExpired func(id ID)
+
+	// Measurement is the InfluxDB measurement where spans are stored, "spans" if unset. Using distinct
+	// measurements allows multiple appdash deployments to share a single InfluxDB database.
+	Measurement string
+
+	// IndexedAnnotations are the annotation keys written as tags(which InfluxDB indexes) instead of
+	// fields, so queries filtering by them(eg. by service name) are efficient. Since tags are part
+	// of the span's series, setting an indexed annotation on an already written span rewrites it.
+	// Indexed annotations with empty values are not stored.
+	IndexedAnnotations []string
+
+	// Labels are tags(eg. region, version or tenant) written on every span's point, so traces can be
+	// filtered by deployment. They're read back as annotations & override the span's annotations with
+	// the same key. Changing them applies to the points written afterwards only.
+	Labels map[string]string
+
+	// MaxReconnectAttempts is the number of times a write or query failing transiently(eg. after a server
+	// restart or a network blip) is retried, re-establishing the connection to InfluxDB before each retry.
+	// Permanent failures(eg. query syntax errors) are never retried, see PermanentError.
+	// ReconnectBackoff is the wait before the first retry(100ms if unset), doubled on each retry.
+	// Zero MaxReconnectAttempts(default) disables retries.
+	MaxReconnectAttempts int
+	ReconnectBackoff     time.Duration
+
+	// MultiRootPolicy is how traces with multiple root spans are handled when read, MultiRootError
+	// by default.
+	MultiRootPolicy MultiRootPolicy
+
+	// CollapseClientServer makes read traces show each call as a single span, instead of a client span
+	// & it's server child span: client spans(see Span.Kind) with a single server child span are merged
+	// with it, adopting it's annotations & children.
+	CollapseClientServer bool
+
+	// MaxChildren is a safety cap on the number of spans read when querying traces(100000 if
+	// unset), spans are read in chunks until all are read or the cap is reached. Traces whose
+	// spans may exceed it are marked as Truncated.
+	MaxChildren int
+
+	// TracesPerPage is the number of traces returned by Traces & TracesPage(when no limit is given),
+	// 10 if unset.
+	TracesPerPage int
+
+	// ReadYourWrites makes the InfluxQL queries wait(up to one second) until the spans written so far
+	// are queryable, so reading right after Collect(eg. Trace) finds the collected span. Buffered spans
+	// are only written once flushed(see Flush). When false(default) queries never wait.
+	ReadYourWrites bool
+
+	// TracesQueryConcurrency makes Traces & TracesInRange fetch the spans of each trace with it's own
+	// query, running up to TracesQueryConcurrency of them concurrently, instead of fetching all the
+	// spans of the page with a single query(default). It may reduce the latency of pages of wide
+	// traces, at the cost of more queries. Spans are then truncated per trace(see MaxChildren).
+	TracesQueryConcurrency int
+
+	// Database is the InfluxDB database name, "appdash" if unset("appdash_test" in test mode). Test
+	// mode drops the database, so it refuses to use the "appdash" one.
+	Database string
+
+	// Token, Org & Bucket connect the store to an InfluxDB 2.x server(see ExternalURL) using token
+	// authentication instead of AdminUser. Spans are written to Bucket within Org & queried through
+	// the InfluxQL compatibility API, which requires Bucket to be mapped to a database of the same
+	// name. Buckets are not created nor dropped by the store, even in test mode.
+	Token  string
+	Org    string
+	Bucket string
+
+	// QueryUser & QueryPassword are the credentials of a non-admin user which performs the queries, so
+	// reads(eg. from the web UI) can't modify the database. Writes, deletes & the database setup are
+	// still performed by AdminUser. The user is created with read privileges on the database if it
+	// doesn't exist. Not supported when using a token.
+	QueryUser     string
+	QueryPassword string
+
+	// QueryLanguage is the language used to query traces, InfluxQL by default. Flux requires Token,
+	// it's used by Trace, Traces & TracesInRange while the other queries still use InfluxQL.
+	QueryLanguage QueryLanguage
+
+	// IDEncoding is how IDs are encoded on the trace_id, trace_id_hi, span_id & parent_id tags, hex by default.
+	// Decimal IDs are shorter & easier to compare against decimal IDs of other systems. Both
+	// encodings can't be mixed within one database, NewInfluxDBStore fails if the database has
+	// root spans written with the other one.
+	IDEncoding IDEncoding
+
+	// StartupTimeout is how long the embedded server is waited for to respond(ie. to be ready for
+	// the database setup) after it's started, 10s if unset.
+	StartupTimeout time.Duration
+
+	// ConnectTimeout is how long connecting to InfluxDB(including the TLS handshake) may take, 5s if
+	// unset. WriteTimeout is how long each write request may take, 10s if unset; timed out writes are
+	// retried like other transient failures(see MaxReconnectAttempts). Queries are bound by QueryTimeout.
+	ConnectTimeout time.Duration
+	WriteTimeout   time.Duration
+
+	// TraceCacheSize is the number of recently queried traces Trace keeps in memory, so fetching
+	// them again(eg. re-rendering a trace page) doesn't query InfluxDB. Cached traces are dropped
+	// once a span of theirs is written or they're deleted. Zero(default) disables the cache.
+	TraceCacheSize int
+
+	// SampleRate is the fraction(between 0 & 1) of traces collected, the spans of the other traces
+	// are discarded by Collect & CollectBatch. Whether a trace is collected depends only on it's ID,
+	// so either all or none of it's spans are. Zero(default) or one collects all the traces.
+	SampleRate float64
+
+	// MaxWritesPerSecond rate limits Collect & CollectBatch(each call counts as one write) allowing
+	// bursts of up to BurstSize writes(1 if unset), so a client flooding spans can't overwhelm InfluxDB.
+	// Calls over the limit wait up to RateLimitWait for their turn, then fail with ErrRateLimited
+	// so callers can back off. Zero MaxWritesPerSecond(default) disables the limit.
+	MaxWritesPerSecond float64
+	BurstSize          int
+	RateLimitWait      time.Duration
+
+	// OnCollect is called for every span collected by Collect & CollectBatch with it's annotations,
+	// once written(or buffered, see BatchSize), eg. to alert on spans as they're stored. It's called
+	// synchronously by the collecting goroutine so it delays Collect, hooks doing slow work(eg. network
+	// requests) must hand it off to another goroutine. Spans discarded by sampling(see SampleRate) or
+	// failing to be written are not observed.
+	OnCollect func(id SpanID, anns []Annotation)
+
+	// TransformAnnotations is applied to the annotations of every span collected by Collect &
+	// CollectBatch before it's written, eg. to scrub sensitive values(like auth headers) or to
+	// normalize keys. The returned annotations are stored instead, including the schemas found on
+	// them, & passed to OnCollect. It may be called concurrently & must not modify the given slice,
+	// which belongs to the caller.
+	TransformAnnotations func([]Annotation) []Annotation
+
+	// CollectMiddleware wraps Collect & CollectContext, the first one being the outermost(ie. it's
+	// called first, with the span given to Collect), eg. to compose sampling, scrubbing or enrichment.
+	// The innermost one's `next` collects the span as configured(eg. sampled, see SampleRate). It's
+	// not applied by CollectBatch, whose spans are written at once(see TransformAnnotations).
+	CollectMiddleware []CollectMiddleware
+}
+
+// validate returns an error describing the first invalid setting of `c`, if any.
+func (c *InfluxDBStoreConfig) validate() error {
+	switch {
+	case c.QueryLanguage == Flux && c.Token == "":
+		return errors.New("appdash: token required when using flux")
+	case c.QueryUser != "" && c.QueryPassword == "":
+		return errors.New("appdash: query password required")
+	case c.QueryUser != "" && c.Token != "":
+		return errors.New("appdash: query user not supported when using a token")
+	case c.Token != "" && c.ExternalURL == "":
+		return errors.New("appdash: external URL required when using a token")
+	case c.Token != "" && c.Org == "":
+		return errors.New("appdash: org required when using a token")
+	case c.Token != "" && c.Bucket == "":
+		return errors.New("appdash: bucket required when using a token")
+	case c.Token != "":
+		// Token authentication, AdminUser & the embedded server settings are not used.
+	case c.AdminUser.Username == "":
+		return errors.New("appdash: admin username required")
+	case c.AdminUser.Password == "":
+		return errors.New("appdash: admin password required")
+	case c.ExternalURL == "" && c.Server == nil:
+		return errors.New("appdash: server config required when no external URL is set")
+	case c.ExternalURL == "" && c.BuildInfo == nil:
+		return errors.New("appdash: build info required when no external URL is set")
+	}
+
+	if d := c.DefaultRP.Duration; d != "" {
+		if err := validateRPDuration(d); err != nil {
+			return fmt.Errorf("appdash: invalid retention policy duration %q: %w", d, err)
+		}
+	}
+	if d := c.DefaultRP.ShardGroupDuration; d != "" {
+		if err := validateShardGroupDuration(d); err != nil {
+			return fmt.Errorf("appdash: invalid shard group duration %q: %w", d, err)
+		}
+	}
+	// Names & credentials are quoted into queries & statements, see quote.
+	quoted := []string{c.Database, c.Measurement, c.DefaultRP.Name, c.QueryUser}
+	quoted = append(quoted, c.IndexedAnnotations...)
+	for k, v := range c.Labels {
+		quoted = append(quoted, k, v)
+	}
+	if err := checkQuotable(quoted...); err != nil {
+		return fmt.Errorf("appdash: invalid config: %w", err)
+	}
+	if checkQuotable(c.QueryPassword) != nil { // Not included on the error, see redacted.
+		return errors.New("appdash: invalid query password, control characters are not allowed")
+	}
+	if c.DefaultRP.ReplicationFactor < 0 {
+		return fmt.Errorf("appdash: invalid replication factor %d", c.DefaultRP.ReplicationFactor)
+	}
+	if c.SampleRate < 0 || c.SampleRate > 1 || math.IsNaN(c.SampleRate) {
+		return fmt.Errorf("appdash: invalid sample rate %v, must be between 0 & 1", c.SampleRate)
+	}
+	if c.MaxWritesPerSecond < 0 || math.IsNaN(c.MaxWritesPerSecond) {
+		return fmt.Errorf("appdash: invalid max writes per second %v", c.MaxWritesPerSecond)
+	}
+	if c.StartupTimeout < 0 {
+		return fmt.Errorf("appdash: invalid startup timeout %s", c.StartupTimeout)
+	}
+	if c.ConnectTimeout < 0 {
+		return fmt.Errorf("appdash: invalid connect timeout %s", c.ConnectTimeout)
+	}
+	if c.WriteTimeout < 0 {
+		return fmt.Errorf("appdash: invalid write timeout %s", c.WriteTimeout)
+	}
+	if c.IDEncoding != HexIDEncoding && c.IDEncoding != DecimalIDEncoding {
+		return fmt.Errorf("appdash: invalid ID encoding %s", c.IDEncoding)
+	}
+	switch c.WriteConsistency {
+	case "", "any", "one", "quorum", "all":
+	default:
+		return fmt.Errorf("appdash: invalid write consistency %q, must be any, one, quorum or all", c.WriteConsistency)
+	}
+	if c.SlowQueryThreshold < 0 {
+		return fmt.Errorf("appdash: invalid slow query threshold %s", c.SlowQueryThreshold)
+	}
+	if c.TracesQueryConcurrency < 0 {
+		return fmt.Errorf("appdash: invalid traces query concurrency %d", c.TracesQueryConcurrency)
+	}
+	if c.QueryTimeout < 0 {
+		return fmt.Errorf("appdash: invalid query timeout %s", c.QueryTimeout)
+	}
+	if c.CircuitBreakerThreshold < 0 {
+		return fmt.Errorf("appdash: invalid circuit breaker threshold %d", c.CircuitBreakerThreshold)
+	}
+	if c.CircuitBreakerCooldown < 0 {
+		return fmt.Errorf("appdash: invalid circuit breaker cooldown %s", c.CircuitBreakerCooldown)
+	}
+	if c.MaxBufferedPoints < 0 {
+		return fmt.Errorf("appdash: invalid max buffered points %d", c.MaxBufferedPoints)
+	}
+	switch c.BufferFullPolicy {
+	case BufferFullBlock, BufferFullDropNewest, BufferFullDropOldest:
+	default:
+		return fmt.Errorf("appdash: invalid buffer full policy %s", c.BufferFullPolicy)
+	}
+	switch {
+	case c.WriteProtocol != HTTPWriteProtocol && c.WriteProtocol != UDPWriteProtocol:
+		return fmt.Errorf("appdash: invalid write protocol %s", c.WriteProtocol)
+	case c.WriteProtocol == UDPWriteProtocol && c.Token != "":
+		return errors.New("appdash: UDP write protocol not supported when using a token")
+	case c.WriteProtocol == UDPWriteProtocol && c.UDPAddr == "":
+		return errors.New("appdash: UDP address required when using the UDP write protocol")
+	}
+	return nil
+}
+
+// rpDurationRegexp matches InfluxDB duration literals(eg. "1h" or "90d"), see validateRPDuration.
+var rpDurationRegexp = regexp.MustCompile(`^[0-9]+(ns|u|µ|ms|s|m|h|d|w)$`)
+
+// errInvalidRPDuration is returned by validateRPDuration for invalid durations.
+var errInvalidRPDuration = errors.New("must be an integer followed by a unit(ns, u, ms, s, m, h, d or w), or INF")
+
+// validateRPDuration returns an error if `d` is not a valid retention policy duration(eg. "1h"), so
+// typos(eg. "1hour") are reported before the duration is placed into a query.
+func validateRPDuration(d string) error {
+	if strings.EqualFold(d, "INF") { // The infinite retention duration.
+		return nil
+	}
+	if !rpDurationRegexp.MatchString(d) {
+		return errInvalidRPDuration
+	}
+	return nil
+}
+
+// validateShardGroupDuration is like validateRPDuration, but shard groups can't be infinite.
+func validateShardGroupDuration(d string) error {
+	if !rpDurationRegexp.MatchString(d) {
+		return errors.New("must be an integer followed by a unit(ns, u, ms, s, m, h, d or w)")
+	}
+	return nil
+}
+
+// redacted is shown instead of passwords & tokens when formatting configs.
+const redacted = "****"
+
+// String returns `c` formatted as with "%+v", but with the passwords, the token & the credentials
+// of ExternalURL redacted, so configs can be logged safely.
+func (c InfluxDBStoreConfig) String() string {
+	type config InfluxDBStoreConfig // Without methods, so formatting it doesn't call String again.
+	return fmt.Sprintf("%+v", config(c.redacted()))
+}
+
+// GoString is like String, but returns `c` formatted as with "%#v".
+func (c InfluxDBStoreConfig) GoString() string {
+	type config InfluxDBStoreConfig
+	return strings.Replace(fmt.Sprintf("%#v", config(c.redacted())), "appdash.config", "appdash.InfluxDBStoreConfig", 1)
+}
+
+// redacted returns a copy of `c` with the passwords, the token & the credentials of ExternalURL redacted.
+func (c InfluxDBStoreConfig) redacted() InfluxDBStoreConfig {
+	c.AdminUser = c.AdminUser.redacted()
+	if c.QueryPassword != "" {
+		c.QueryPassword = redacted
+	}
+	if c.Token != "" {
+		c.Token = redacted
+	}
+	c.ExternalURL = redactURL(c.ExternalURL)
+	return c
 }
 
 type InfluxDBAdminUser struct {
@@ -724,7 +2637,155 @@ type InfluxDBAdminUser struct {
 	Password string
 }
 
+// String returns `u` formatted as with "%+v", but with the password redacted.
+func (u InfluxDBAdminUser) String() string {
+	type user InfluxDBAdminUser
+	return fmt.Sprintf("%+v", user(u.redacted()))
+}
+
+// GoString is like String, but returns `u` formatted as with "%#v".
+func (u InfluxDBAdminUser) GoString() string {
+	type user InfluxDBAdminUser
+	return strings.Replace(fmt.Sprintf("%#v", user(u.redacted())), "appdash.user", "appdash.InfluxDBAdminUser", 1)
+}
+
+// redacted returns a copy of `u` with the password redacted.
+func (u InfluxDBAdminUser) redacted() InfluxDBAdminUser {
+	if u.Password != "" {
+		u.Password = redacted
+	}
+	return u
+}
+
+// redactURL returns `rawURL` with the password of it's userinfo(if any) redacted, or a placeholder
+// if it can't be parsed(since the credentials can't be told apart).
+func redactURL(rawURL string) string {
+	if rawURL == "" {
+		return ""
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "<invalid URL>"
+	}
+	if _, hasPassword := u.User.Password(); hasPassword {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	return u.String()
+}
+
 func NewInfluxDBStore(config InfluxDBStoreConfig) (*InfluxDBStore, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	in := InfluxDBStore{
+		adminUser:   config.AdminUser,
+		defaultRP:   config.DefaultRP,
+		externalURL: config.ExternalURL,
+		host:        config.Host,
+		port:        config.Port,
+		mode:        config.Mode,
+		secure:      config.Secure,
+		tlsConfig:   config.TLSConfig,
+
+		batchSize:        config.BatchSize,
+		flushInterval:    config.FlushInterval,
+		writeConsistency: config.WriteConsistency,
+		writeProtocol:    config.WriteProtocol,
+		udpAddr:          config.UDPAddr,
+		metrics:          config.Metrics,
+		stats:            &storeStats{},
+		writeErrors:      make(chan error, writeErrorsSize),
+
+		logger:             config.Logger,
+		slowQueryThreshold: config.SlowQueryThreshold,
+		queryTimeout:       config.QueryTimeout,
+
+		maxBufferedPoints: config.MaxBufferedPoints,
+		bufferFullPolicy:  config.BufferFullPolicy,
+
+		maxAge:          config.MaxAge,
+		cleanupInterval: config.CleanupInterval,
+		onTraceExpired:  config.OnTraceExpired,
+		measurement:     config.Measurement,
+
+		maxReconnectAttempts: config.MaxReconnectAttempts,
+		reconnectBackoff:     config.ReconnectBackoff,
+		startupTimeout:       config.StartupTimeout,
+		connectTimeout:       config.ConnectTimeout,
+		writeTimeout:         config.WriteTimeout,
+		traceCache:           newTraceCache(config.TraceCacheSize),
+		collected:            newCollectedPoints(collectedPointsSize),
+		traceIDHighs:         newTraceIDHighs(traceIDHighsSize),
+		sampleRate:           config.SampleRate,
+		limiter:              newWriteLimiter(config.MaxWritesPerSecond, config.BurstSize, config.RateLimitWait),
+		breaker:              newCircuitBreaker(config.CircuitBreakerThreshold, config.CircuitBreakerCooldown),
+		onCollect:            config.OnCollect,
+		transformAnnotations: config.TransformAnnotations,
+		middleware:           append([]CollectMiddleware(nil), config.CollectMiddleware...),
+
+		multiRootPolicy: config.MultiRootPolicy,
+		maxChildren:     config.MaxChildren,
+		tracesPerPage:   config.TracesPerPage,
+		dbName:          config.Database,
+		token:           config.Token,
+		org:             config.Org,
+		queryLanguage:   config.QueryLanguage,
+		idEncoding:      config.IDEncoding,
+		queryUser:       InfluxDBAdminUser{Username: config.QueryUser, Password: config.QueryPassword},
+
+		tracesQueryConcurrency: config.TracesQueryConcurrency,
+		readYourWrites:         config.ReadYourWrites,
+		collapseClientServer:   config.CollapseClientServer,
+	}
+	if in.token != "" {
+		in.dbName = config.Bucket
+	}
+	if in.measurement == "" {
+		in.measurement = spanMeasurementName
+	}
+	if in.maxChildren <= 0 {
+		in.maxChildren = defaultMaxChildren
+	}
+	if len(in.middleware) > 0 {
+		in.chain = in.collectChain(context.Background())
+	}
+	if len(config.IndexedAnnotations) > 0 {
+		in.indexedAnnotations = make(map[string]struct{}, len(config.IndexedAnnotations))
+		for _, key := range config.IndexedAnnotations {
+			switch key {
+			case "trace_id", traceIDHighTag, "span_id", "parent_id", "time", schemasFieldName, kindTag:
+				return nil, fmt.Errorf("appdash influxdb: reserved key %q cannot be an indexed annotation", key)
+			}
+			in.indexedAnnotations[key] = struct{}{}
+		}
+	}
+	if len(config.Labels) > 0 {
+		in.labels = make(map[string]string, len(config.Labels))
+		for key, value := range config.Labels {
+			switch key {
+			case "trace_id", traceIDHighTag, "span_id", "parent_id", "time", schemasFieldName, errorTag, kindTag:
+				return nil, fmt.Errorf("appdash influxdb: reserved key %q cannot be a label", key)
+			}
+			if value == "" {
+				return nil, fmt.Errorf("appdash influxdb: empty value for label %q", key)
+			}
+			in.labels[key] = value
+		}
+	}
+	if in.host == "" {
+		in.host = influxDBClient.DefaultHost
+	}
+	if in.port == 0 {
+		in.port = influxDBClient.DefaultPort
+	}
+	if config.ExternalURL != "" {
+		if err := in.init(nil); err != nil {
+			return nil, err
+		}
+		in.startFlushing()
+		in.startCleanup()
+		return &in, nil
+	}
 	s, err := influxDBServer.NewServer(config.Server, config.BuildInfo)
 	if err != nil {
 		return nil, err
@@ -732,13 +2793,11 @@ func NewInfluxDBStore(config InfluxDBStoreConfig) (*InfluxDBStore, error) {
 	if err := s.Open(); err != nil {
 		return nil, err
 	}
-	in := InfluxDBStore{
-		adminUser: config.AdminUser,
-		defaultRP: config.DefaultRP,
-		mode:      config.Mode,
-	}
+	in.buildInfo = config.BuildInfo
 	if err := in.init(s); err != nil {
 		return nil, err
 	}
+	in.startFlushing()
+	in.startCleanup()
 	return &in, nil
 }
@@ -0,0 +1,129 @@
+package appdash
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// validTenant matches the valid tenant names, which are part of their database name(see tenantDBName).
+var validTenant = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// errTenantToken is returned when using a tenant with an InfluxDB 2.x server, whose buckets aren't
+// managed by InfluxDBStore.
+var errTenantToken = errors.New("tenants not supported when using a token")
+
+// tenantKey is the context key of the tenant set by WithTenant.
+type tenantKey struct{}
+
+// WithTenant returns a copy of `ctx` making the InfluxDBStore methods taking it(eg. CollectContext,
+// TraceContext & TracesContext) use the database of `tenant` instead of the store's one, so tenants'
+// spans(eg. of different apps) are kept apart. It's an error to use a tenant whose name contains
+// anything but letters, digits & underscores, or to use a tenant when using a token.
+//
+// The database of a tenant is named after the store's one(eg. "appdash_acme" for tenant "acme") & it's
+// created on first use, like the store's one(see InfluxDBStoreConfig.DefaultRP & QueryUser). Tenants'
+// spans are always written right away through the HTTP API(see InfluxDBStoreConfig.BatchSize &
+// WriteProtocol), their traces are never cached(see TraceCacheSize) & reading them never waits for
+// writes(see ReadYourWrites). Delete & the retention cleanups(see MaxAge) only apply to the store's
+// database.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// tenantFromContext returns the tenant set on `ctx` by WithTenant, empty if none.
+func tenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// Tenant returns a store of `tenant`'s spans, whose methods are like calling the InfluxDBStore ones
+// with a context set by WithTenant.
+func (in *InfluxDBStore) Tenant(tenant string) *InfluxDBTenantStore {
+	return &InfluxDBTenantStore{store: in, tenant: tenant}
+}
+
+// InfluxDBTenantStore is a Store & Queryer of a tenant's spans, see InfluxDBStore.Tenant.
+type InfluxDBTenantStore struct {
+	store  *InfluxDBStore
+	tenant string
+}
+
+// Collect is like InfluxDBStore.Collect, but collects the span on the tenant's database.
+func (t *InfluxDBTenantStore) Collect(id SpanID, anns ...Annotation) error {
+	return t.store.CollectContext(t.context(), id, anns...)
+}
+
+// Trace is like InfluxDBStore.Trace, but queries the tenant's database.
+func (t *InfluxDBTenantStore) Trace(id ID) (*Trace, error) {
+	return t.store.TraceContext(t.context(), id)
+}
+
+// Traces is like InfluxDBStore.Traces, but queries the tenant's database.
+func (t *InfluxDBTenantStore) Traces() ([]*Trace, error) {
+	return t.store.TracesContext(t.context())
+}
+
+func (t *InfluxDBTenantStore) context() context.Context {
+	return WithTenant(context.Background(), t.tenant)
+}
+
+// tenantDBName returns the name of `tenant`'s database.
+func (in *InfluxDBStore) tenantDBName(tenant string) string {
+	return in.dbName + "_" + tenant
+}
+
+// database returns the name of the database used with `ctx`(see WithTenant). A tenant's database is
+// set up once it's first used by the store, in test mode it's dropped first(like `in.dbName`).
+func (in *InfluxDBStore) database(ctx context.Context) (string, error) {
+	tenant := tenantFromContext(ctx)
+	if tenant == "" {
+		return in.dbName, nil
+	}
+	if in.token != "" {
+		return "", errTenantToken
+	}
+	if !validTenant.MatchString(tenant) {
+		return "", fmt.Errorf("appdash influxdb: invalid tenant %q", tenant)
+	}
+	db := in.tenantDBName(tenant)
+
+	// Held while setting up, so concurrent first uses set it up only once.
+	in.tenantsMu.Lock()
+	defer in.tenantsMu.Unlock()
+	if in.tenantDBs[tenant] {
+		return db, nil
+	}
+	if in.mode == testMode {
+		if err := in.dropDB(ctx, db); err != nil {
+			return "", err
+		}
+	}
+	if err := in.createDBIfNotExists(ctx, db); err != nil {
+		return "", err
+	}
+	// Not using the tenant's database, which is being set up.
+	if err := in.grantQueryUser(WithTenant(ctx, ""), db); err != nil {
+		return "", fmt.Errorf("appdash influxdb: granting query user on %s: %w", db, err)
+	}
+	if in.tenantDBs == nil {
+		in.tenantDBs = make(map[string]bool)
+	}
+	in.tenantDBs[tenant] = true
+	return db, nil
+}
+
+// tenantDigest returns the digest of a point(see digestPoint) collected for `tenant`, so the same
+// point collected for different tenants isn't skipped(see collectedPoints). It's `d` if no tenant is set.
+func tenantDigest(tenant string, d pointDigest) pointDigest {
+	if tenant == "" {
+		return d
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%q\x00", tenant)
+	h.Write(d[:])
+	copy(d[:], h.Sum(nil))
+	return d
+}
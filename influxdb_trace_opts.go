@@ -0,0 +1,136 @@
+package appdash
+
+import (
+	"context"
+	"fmt"
+
+	influxDBModels "github.com/influxdata/influxdb/models"
+)
+
+// TraceOpts limits the spans returned by InfluxDBStore.TraceWithOpts, zero values mean no limit.
+type TraceOpts struct {
+	// MaxDepth is the maximum number of tree levels returned, the root span being the first one.
+	MaxDepth int
+
+	// MaxSpans is the maximum number of spans returned.
+	MaxSpans int
+}
+
+// TraceWithOpts is like Trace, but returns at most `opts` levels & spans of the trace, which is
+// marked as Truncated if some were left out. The trace is queried level by level, so spans
+// beyond the limits are never read.
+func (in *InfluxDBStore) TraceWithOpts(id ID, opts TraceOpts) (*Trace, error) {
+	if opts.MaxDepth <= 0 && opts.MaxSpans <= 0 {
+		return in.Trace(id)
+	}
+	ctx := context.Background()
+	var (
+		series    []influxDBModels.Row
+		parents   = []ID{0} // Parent span IDs of the current level, the root spans have none.
+		truncated bool
+	)
+	for depth := 1; len(parents) > 0; depth++ {
+		// Queries one more span than allowed, to find out whether there are spans left out.
+		limit := 0
+		if opts.MaxSpans > 0 {
+			limit = opts.MaxSpans - len(series) + 1
+		}
+		overDepth := opts.MaxDepth > 0 && depth > opts.MaxDepth
+		if overDepth {
+			limit = 1
+		}
+		level, more, err := in.traceLevel(ctx, id, parents, limit)
+		if err != nil {
+			return nil, fmt.Errorf("appdash influxdb: querying trace %s: %w", id, err)
+		}
+		if overDepth {
+			truncated = len(level) > 0
+			break
+		}
+		if opts.MaxSpans > 0 && len(series)+len(level) > opts.MaxSpans {
+			level = level[:opts.MaxSpans-len(series)]
+			more = true
+		}
+		truncated = truncated || more
+		series = append(series, level...)
+		if truncated {
+			break
+		}
+		parents = parents[:0]
+		for _, s := range level {
+			spanID, err := in.idEncoding.parse(s.Tags["span_id"])
+			if err != nil {
+				return nil, err
+			}
+			parents = append(parents, spanID)
+		}
+	}
+	if len(series) == 0 {
+		// The root span is missing(see traceFromSeries), so the levels are unknown.
+		trace, err := in.Trace(id)
+		if err != nil {
+			return nil, err
+		}
+		trace.Truncated = pruneTrace(trace, opts)
+		return trace, nil
+	}
+	// Like Trace, the lowest high bits of the trace ID win(see Trace128).
+	his, byHigh, err := splitByTraceIDHigh(series, in.idEncoding)
+	if err != nil {
+		return nil, err
+	}
+	trace, err := in.traceFromSeries(traceKey{hi: his[0], id: id}, byHigh[his[0]])
+	if err != nil {
+		return nil, err
+	}
+	trace.Truncated = truncated
+	return trace, nil
+}
+
+// traceLevel returns up to `limit`(zero means no limit) spans of the trace `id` whose parent is
+// any of `parents`, and whether the limit was reached(ie. there may be more spans).
+func (in *InfluxDBStore) traceLevel(ctx context.Context, id ID, parents []ID, limit int) ([]influxDBModels.Row, bool, error) {
+	q := fmt.Sprintf("SELECT * FROM %s WHERE trace_id=%s AND %s GROUP BY *", quoteIdent(in.measurement), quoteTag(in.idEncoding.format(id)), in.idsCondition("parent_id", parents))
+	if limit > 0 {
+		q += fmt.Sprintf(" SLIMIT %d", limit)
+	}
+	result, err := in.executeOneQuery(ctx, q)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// SLIMIT limits series, so it's reached before the limit of spans when spans have several series.
+	more := limit > 0 && len(result.Series) >= limit
+	if result.Series, err = mergeSeries(result.Series); err != nil {
+		return nil, false, err
+	}
+	return result.Series, more, nil
+}
+
+// pruneTrace removes the spans of `root` beyond `opts` limits(levels are walked in order),
+// returns true if any span was removed.
+func pruneTrace(root *Trace, opts TraceOpts) bool {
+	var (
+		pruned bool
+		spans  = 1
+		level  = []*Trace{root}
+	)
+	for depth := 1; len(level) > 0; depth++ {
+		var next []*Trace
+		for _, t := range level {
+			if opts.MaxDepth > 0 && depth >= opts.MaxDepth {
+				pruned = pruned || len(t.Sub) > 0
+				t.Sub = nil
+				continue
+			}
+			if opts.MaxSpans > 0 && spans+len(t.Sub) > opts.MaxSpans {
+				t.Sub = t.Sub[:opts.MaxSpans-spans]
+				pruned = true
+			}
+			spans += len(t.Sub)
+			next = append(next, t.Sub...)
+		}
+		level = next
+	}
+	return pruned
+}
@@ -0,0 +1,200 @@
+package appdash
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	influxDBClient "github.com/influxdata/influxdb/client"
+	influxDBModels "github.com/influxdata/influxdb/models"
+)
+
+// TraceIDHighAnnotationKey is the key of the annotation holding the high 64 bits(as a hex
+// string, see ID.String) of a 128-bit trace ID, as used by OpenTelemetry & Zipkin; ID only
+// holds the low 64 bits. InfluxDBStore stores it as the trace_id_hi tag instead of as an
+// annotation, so traces whose trace IDs only share their low 64 bits are kept apart(see
+// InfluxDBStore.Trace128 & Trace.TraceIDHigh).
+//
+// Once a span of such a trace is collected with it, the store remembers it's high bits(see
+// traceIDHighs), so the trace's spans it collects later without it are tagged too. Spans collected
+// without it before that(or by another store) form a separate trace, with a 64-bit trace ID.
+const TraceIDHighAnnotationKey = "_traceIDHigh"
+
+// traceIDHighTag is the tag holding the high 64 bits of 128-bit trace IDs, it's not set(ie. empty)
+// for 64-bit trace IDs.
+const traceIDHighTag = "trace_id_hi"
+
+// traceIDHighsSize is the number of recently collected 128-bit traces remembered, see traceIDHighs.
+const traceIDHighsSize = 10000
+
+// traceIDHighs is a size-bounded LRU map of the high 64 bits of the trace IDs of the 128-bit traces
+// recently collected(see TraceIDHighAnnotationKey), by tenant & low 64 bits. A nil *traceIDHighs
+// remembers nothing.
+type traceIDHighs struct {
+	mu    sync.Mutex
+	size  int                             // Maximum number of remembered traces.
+	order *list.List                      // Remembered traces, most recently collected first; values are *traceIDHigh.
+	high  map[tenantTraceID]*list.Element // Elements of `order` by trace.
+}
+
+// tenantTraceID identifies a trace by the low 64 bits of it's trace ID, within a tenant(see WithTenant).
+type tenantTraceID struct {
+	tenant string
+	id     ID
+}
+
+// traceIDHigh is a trace remembered by traceIDHighs, along with it's trace_id_hi tag.
+type traceIDHigh struct {
+	trace tenantTraceID
+	tag   string
+}
+
+// newTraceIDHighs returns a map of up to `size` traces.
+func newTraceIDHighs(size int) *traceIDHighs {
+	return &traceIDHighs{
+		size:  size,
+		order: list.New(),
+		high:  make(map[tenantTraceID]*list.Element, size),
+	}
+}
+
+// tag remembers the trace_id_hi tag of `p`, a point of a span of the trace `id` collected for `tenant`.
+// If it's not set, it's set to the one remembered for the trace instead(if any).
+func (h *traceIDHighs) tag(tenant string, id ID, p *influxDBClient.Point) {
+	if h == nil {
+		return
+	}
+	trace := tenantTraceID{tenant: tenant, id: id}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e, found := h.high[trace]
+	tag := p.Tags[traceIDHighTag]
+	switch {
+	case tag == "" && found:
+		h.order.MoveToFront(e)
+		p.Tags[traceIDHighTag] = e.Value.(*traceIDHigh).tag
+	case tag == "":
+	case found:
+		h.order.MoveToFront(e)
+		e.Value.(*traceIDHigh).tag = tag
+	default:
+		h.high[trace] = h.order.PushFront(&traceIDHigh{trace: trace, tag: tag})
+		if h.order.Len() > h.size {
+			oldest := h.order.Back()
+			h.order.Remove(oldest)
+			delete(h.high, oldest.Value.(*traceIDHigh).trace)
+		}
+	}
+}
+
+// traceKey identifies a trace by both parts of it's trace ID.
+type traceKey struct {
+	hi ID // High 64 bits, zero for 64-bit trace IDs.
+	id ID // Low 64 bits.
+}
+
+// spanKey identifies a span by it's ID & the high 64 bits of it's trace ID.
+type spanKey struct {
+	hi ID
+	id SpanID
+}
+
+// Trace128 is like Trace, but returns the trace whose 128-bit trace ID is made of `hi`(high 64
+// bits) & `id`(low 64 bits), see TraceIDHighAnnotationKey. A zero `hi` means a 64-bit trace ID.
+//
+// Trace(id) returns the trace with the lowest high 64 bits among those whose trace ID ends with
+// `id`, which is the only one unless 128-bit trace IDs collide. Unlike Trace, it's never cached.
+func (in *InfluxDBStore) Trace128(hi, id ID) (*Trace, error) {
+	return in.trace128(context.Background(), hi, id)
+}
+
+// trace128 is like Trace128, but the query it performs is aborted once `ctx` is cancelled.
+func (in *InfluxDBStore) trace128(ctx context.Context, hi, id ID) (*Trace, error) {
+	series, truncated, err := in.traceSeries(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	_, byHigh, err := splitByTraceIDHigh(series, in.idEncoding)
+	if err != nil {
+		return nil, err
+	}
+	if len(byHigh[hi]) == 0 {
+		return nil, ErrTraceNotFound
+	}
+	trace, err := in.traceFromSeries(traceKey{hi: hi, id: id}, byHigh[hi])
+	if err != nil {
+		return nil, err
+	}
+	trace.Truncated = truncated
+	return trace, nil
+}
+
+// splitByTraceIDHigh groups `series`(spans sharing the low 64 bits of their trace ID, encoded with
+// `enc`) by the high 64 bits of their trace ID, which are returned sorted.
+func splitByTraceIDHigh(series []influxDBModels.Row, enc IDEncoding) ([]ID, map[ID][]influxDBModels.Row, error) {
+	var (
+		his    []ID
+		byHigh = make(map[ID][]influxDBModels.Row)
+	)
+	for _, s := range series {
+		hi, err := tagsTraceIDHigh(s.Tags, enc)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, present := byHigh[hi]; !present {
+			his = append(his, hi)
+		}
+		byHigh[hi] = append(byHigh[hi], s)
+	}
+	sort.Sort(byID(his))
+	return his, byHigh, nil
+}
+
+// rowTraceKey returns the trace key of `r`, a span series whose IDs are encoded with `enc`.
+func rowTraceKey(r *influxDBModels.Row, enc IDEncoding) (traceKey, error) {
+	id, err := enc.parse(r.Tags["trace_id"])
+	if err != nil {
+		return traceKey{}, err
+	}
+	hi, err := tagsTraceIDHigh(r.Tags, enc)
+	if err != nil {
+		return traceKey{}, err
+	}
+	return traceKey{hi: hi, id: id}, nil
+}
+
+// tagsTraceIDHigh returns the high 64 bits of the trace ID from a span's `tags`(whose IDs are
+// encoded with `enc`), zero if unset.
+func tagsTraceIDHigh(tags map[string]string, enc IDEncoding) (ID, error) {
+	v := tags[traceIDHighTag]
+	if v == "" {
+		return 0, nil
+	}
+	hi, err := enc.parse(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s tag %q", traceIDHighTag, v)
+	}
+	return hi, nil
+}
+
+// splitTraceIDHigh returns the high 64 bits of the trace ID set by `anns`(zero if none, see
+// TraceIDHighAnnotationKey) & the rest of `anns`, which is never modified. Invalid values are
+// kept as regular annotations.
+func splitTraceIDHigh(anns []Annotation) (ID, []Annotation) {
+	for i, a := range anns {
+		if a.Key != TraceIDHighAnnotationKey {
+			continue
+		}
+		hi, err := ParseID(string(a.Value))
+		if err != nil {
+			continue
+		}
+		rest := make([]Annotation, 0, len(anns)-1)
+		rest = append(rest, anns[:i]...)
+		rest = append(rest, anns[i+1:]...)
+		return hi, rest
+	}
+	return 0, anns
+}
@@ -0,0 +1,75 @@
+package appdash
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	influxDBClient "github.com/influxdata/influxdb/client"
+	influxDBModels "github.com/influxdata/influxdb/models"
+)
+
+// udpPayloadSize is the maximum size of the UDP packets written, many points are written per packet
+// up to this size(a larger point is written alone). It's below the usual MTU, so packets aren't fragmented.
+const udpPayloadSize = 1024
+
+// WriteProtocol is how InfluxDBStore writes spans, see InfluxDBStoreConfig.WriteProtocol.
+type WriteProtocol int
+
+const (
+	// HTTPWriteProtocol writes spans through the InfluxDB HTTP API(default).
+	HTTPWriteProtocol WriteProtocol = iota
+
+	// UDPWriteProtocol writes spans to an InfluxDB UDP listener, queries still use the HTTP API.
+	UDPWriteProtocol
+)
+
+// String returns the name of `p`, eg. "HTTP".
+func (p WriteProtocol) String() string {
+	switch p {
+	case HTTPWriteProtocol:
+		return "HTTP"
+	case UDPWriteProtocol:
+		return "UDP"
+	default:
+		return fmt.Sprintf("WriteProtocol(%d)", int(p))
+	}
+}
+
+// dialUDP connects to the InfluxDB UDP listener at `in.udpAddr`, if the UDP write protocol is used.
+func (in *InfluxDBStore) dialUDP() error {
+	if in.writeProtocol != UDPWriteProtocol {
+		return nil
+	}
+	con, err := net.Dial("udp", in.udpAddr)
+	if err != nil {
+		return err
+	}
+	in.udp = con
+	return nil
+}
+
+// writeUDP writes `pts` to the InfluxDB UDP listener, within as few packets as possible. It's fire &
+// forget: only local failures(eg. invalid points) are returned, lost packets are never reported.
+func (in *InfluxDBStore) writeUDP(pts []influxDBClient.Point) error {
+	var b bytes.Buffer
+	for _, p := range pts {
+		pt, err := influxDBModels.NewPoint(p.Measurement, p.Tags, p.Fields, p.Time)
+		if err != nil {
+			return err
+		}
+		line := pt.String() + "\n"
+		if b.Len() > 0 && b.Len()+len(line) > udpPayloadSize {
+			if _, err := in.udp.Write(b.Bytes()); err != nil {
+				return err
+			}
+			b.Reset()
+		}
+		b.WriteString(line)
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+	_, err := in.udp.Write(b.Bytes())
+	return err
+}
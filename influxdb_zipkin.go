@@ -0,0 +1,185 @@
+package appdash
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// zipkinSpan is a span in the Zipkin v2 JSON format, see https://zipkin.io/zipkin-api/#/.
+type zipkinSpan struct {
+	TraceID   string            `json:"traceId"`
+	ID        string            `json:"id"`
+	ParentID  string            `json:"parentId,omitempty"`
+	Name      string            `json:"name,omitempty"`
+	Kind      string            `json:"kind,omitempty"`
+	Timestamp int64             `json:"timestamp,omitempty"` // Microseconds since the Unix epoch.
+	Duration  int64             `json:"duration,omitempty"`  // Microseconds.
+	Tags      map[string]string `json:"tags,omitempty"`
+}
+
+// ExportZipkin returns the trace `id` as a Zipkin v2 JSON list of spans, so it can be imported by
+// Zipkin UIs & tooling. Span annotations are exported as tags, except the name(see Span.Name) &
+// the schemas, and the timestamp & duration are those of the span's timespan events.
+func (in *InfluxDBStore) ExportZipkin(id ID) ([]byte, error) {
+	trace, err := in.Trace(id)
+	if err != nil {
+		return nil, err
+	}
+	traceID := trace.ID.Trace.String()
+	if trace.TraceIDHigh != 0 {
+		traceID = trace.TraceIDHigh.String() + traceID
+	}
+	b, err := json.Marshal(zipkinSpans(trace, traceID, nil))
+	if err != nil {
+		return nil, fmt.Errorf("appdash influxdb: exporting trace %s: %w", id, err)
+	}
+	return b, nil
+}
+
+// zipkinSpans appends the spans of `t`(walked depth first) to `spans` as Zipkin spans of the trace `traceID`.
+func zipkinSpans(t *Trace, traceID string, spans []zipkinSpan) []zipkinSpan {
+	s := zipkinSpan{
+		TraceID: traceID,
+		ID:      t.ID.Span.String(),
+		Name:    t.Span.Name(),
+	}
+	if t.ID.Parent != 0 {
+		s.ParentID = t.ID.Parent.String()
+	}
+	var events []Event
+	if err := UnmarshalEvents(t.Annotations, &events); err == nil {
+		if start, end, ok := findTraceTimes(events); ok && !end.Before(start) {
+			s.Timestamp = start.UnixNano() / int64(time.Microsecond)
+			s.Duration = int64(end.Sub(start) / time.Microsecond)
+		}
+	}
+	for _, a := range t.Annotations {
+		switch {
+		case a.Key == schemaPrefix+"HTTPServer":
+			s.Kind = "SERVER"
+		case a.Key == schemaPrefix+"HTTPClient":
+			s.Kind = "CLIENT"
+		case a.Key == nameAnnotationKey || strings.HasPrefix(a.Key, schemaPrefix):
+		default:
+			if s.Tags == nil {
+				s.Tags = make(map[string]string)
+			}
+			s.Tags[a.Key] = string(a.Value)
+		}
+	}
+	spans = append(spans, s)
+	for _, sub := range t.Sub {
+		spans = zipkinSpans(sub, traceID, spans)
+	}
+	for _, sub := range t.UnattachedSpans {
+		spans = zipkinSpans(sub, traceID, spans)
+	}
+	return spans
+}
+
+// ImportZipkin collects the spans of `data`, a Zipkin v2 JSON list of spans, through CollectBatch.
+// Each span gets a name & a timespan event(from it's timestamp & duration, if any), while it's tags
+// are collected as plain annotations. Spans sharing their ID(eg. the client & server sides of an
+// RPC) are collected as a single span.
+//
+// As ID is a 64-bit value, the high 64 bits of 128-bit trace IDs are collected as the
+// TraceIDHighAnnotationKey annotation, see Trace128.
+func (in *InfluxDBStore) ImportZipkin(data []byte) error {
+	spans, err := spansFromZipkin(data)
+	if err != nil {
+		return fmt.Errorf("appdash influxdb: importing zipkin spans: %w", err)
+	}
+	// One batch per high 64 bits of the trace IDs, as spans of traces sharing their low 64 bits
+	// may share their SpanID.
+	for _, batch := range spans {
+		if err := in.CollectBatch(batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// spansFromZipkin returns the spans(span ID -> annotations) of `data` by the high 64 bits of their
+// trace ID(zero for 64-bit trace IDs), see ImportZipkin.
+func spansFromZipkin(data []byte) (map[ID]map[SpanID][]Annotation, error) {
+	var zspans []zipkinSpan
+	if err := json.Unmarshal(data, &zspans); err != nil {
+		return nil, err
+	}
+	spans := make(map[ID]map[SpanID][]Annotation)
+	for _, s := range zspans {
+		hi, id, err := zipkinSpanID(s)
+		if err != nil {
+			return nil, err
+		}
+		if spans[hi] == nil {
+			spans[hi] = make(map[SpanID][]Annotation)
+		}
+		// The name & timespan of spans sharing their ID are those of the first one.
+		anns, seen := spans[hi][id]
+		if hi != 0 && !seen {
+			anns = append(anns, Annotation{Key: TraceIDHighAnnotationKey, Value: []byte(hi.String())})
+		}
+		var events []Event
+		if s.Name != "" && !seen {
+			events = append(events, SpanName(s.Name))
+		}
+		if s.Timestamp > 0 && !seen {
+			start := time.Unix(0, s.Timestamp*int64(time.Microsecond)).UTC()
+			events = append(events, Timespan{S: start, E: start.Add(time.Duration(s.Duration) * time.Microsecond)})
+		}
+		for _, e := range events {
+			a, err := MarshalEvent(e)
+			if err != nil {
+				return nil, err
+			}
+			anns = append(anns, a...)
+		}
+		for k, v := range s.Tags {
+			anns = append(anns, Annotation{Key: k, Value: []byte(v)})
+		}
+		spans[hi][id] = anns
+	}
+	return spans, nil
+}
+
+// zipkinSpanID returns the ID of the Zipkin span `s`(a missing parent ID means it's a root span),
+// along with the high 64 bits of it's trace ID(zero for 64-bit trace IDs).
+func zipkinSpanID(s zipkinSpan) (ID, SpanID, error) {
+	var (
+		hi      ID
+		traceID = s.TraceID
+		err     error
+	)
+	switch len(traceID) {
+	case 16:
+	case 32:
+		if hi, err = ParseID(traceID[:16]); err != nil {
+			return 0, SpanID{}, fmt.Errorf("invalid trace ID %q", s.TraceID)
+		}
+		traceID = traceID[16:]
+	default:
+		return 0, SpanID{}, fmt.Errorf("invalid trace ID %q", s.TraceID)
+	}
+	trace, err := ParseID(traceID)
+	if err != nil {
+		return 0, SpanID{}, fmt.Errorf("invalid trace ID %q", s.TraceID)
+	}
+	span, err := ParseID(s.ID)
+	if err != nil || len(s.ID) != 16 {
+		return 0, SpanID{}, fmt.Errorf("invalid span ID %q", s.ID)
+	}
+	if span == 0 {
+		return 0, SpanID{}, errors.New("invalid zero span ID")
+	}
+	var parent ID
+	if s.ParentID != "" {
+		if parent, err = ParseID(s.ParentID); err != nil || len(s.ParentID) != 16 {
+			return 0, SpanID{}, fmt.Errorf("invalid parent ID %q", s.ParentID)
+		}
+	}
+	return hi, SpanID{Trace: trace, Span: span, Parent: parent}, nil
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"sourcegraph.com/sourcegraph/appdash/internal/wire"
 )
@@ -135,11 +136,34 @@ func ParseSpanID(s string) (*SpanID, error) {
 }
 
 // Span is a span ID and its annotations.
+//
+// Span used to hold only its ID and annotations. The times and kind decoded
+// by stores (Start, End, FirstSeen, LastUpdated and Kind) were added since,
+// which breaks unkeyed Span literals (eg. Span{id, anns}): use keyed ones
+// (eg. Span{ID: id, Annotations: anns}), as fields may be added again.
 type Span struct {
 	// ID probabilistically uniquely identifies this span.
 	ID SpanID
 
 	Annotations
+
+	// Start and End are the earliest start and latest end times of the
+	// span's timespan events (see TimespanEvent), as decoded by stores
+	// when reading spans (eg. InfluxDBStore). They're zero if the span
+	// has no timespan events, or if it was not read from such a store.
+	Start, End time.Time
+
+	// FirstSeen and LastUpdated are the times the span was first collected
+	// and last collected with new annotations, as decoded by stores
+	// recording them (eg. InfluxDBStore). They're zero if the span was not
+	// read from such a store, or was collected before they were recorded.
+	FirstSeen, LastUpdated time.Time
+
+	// Kind is the span's side of a call, ClientSpanKind or ServerSpanKind,
+	// as decoded by stores from it's "span.kind" (or "kind") annotation. It's
+	// empty if the span has no such annotation, or if it was not read from
+	// such a store.
+	Kind string `json:",omitempty"`
 }
 
 // String returns the Span as a formatted string.
@@ -24,6 +24,22 @@ var (
 	// ErrTraceNotFound is returned by Store.GetTrace when no trace is
 	// found with the given ID.
 	ErrTraceNotFound = errors.New("trace not found")
+
+	// ErrSpanNotFound is returned by InfluxDBStore.GetSpan when no span
+	// is found with the given ID.
+	ErrSpanNotFound = errors.New("span not found")
+
+	// ErrRateLimited is returned by InfluxDBStore.Collect & CollectBatch when
+	// the writes rate limit is exceeded (see InfluxDBStoreConfig.MaxWritesPerSecond).
+	ErrRateLimited = errors.New("rate limited")
+
+	// ErrCircuitOpen is returned by InfluxDBStore.Collect & CollectBatch while
+	// writes are fast-failed (see InfluxDBStoreConfig.CircuitBreakerThreshold).
+	ErrCircuitOpen = errors.New("circuit open")
+
+	// ErrQueryTimeout is returned by InfluxDBStore queries taking longer
+	// than allowed (see InfluxDBStoreConfig.QueryTimeout).
+	ErrQueryTimeout = errors.New("query timeout")
 )
 
 // A Queryer indexes spans and makes them queryable.
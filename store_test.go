@@ -59,7 +59,7 @@ func TestMemoryStore_Collect_collectSameChildTwice(t *testing.T) {
 	want1 := &Trace{
 		Span: Span{ID: SpanID{1, 1, 0}},
 		Sub: []*Trace{
-			{Span: Span{SpanID{1, 2, 1}, Annotations{{Key: "k1"}, {Key: "k2"}}}},
+			{Span: Span{ID: SpanID{1, 2, 1}, Annotations: Annotations{{Key: "k1"}, {Key: "k2"}}}},
 		},
 	}
 	if x := ms.MustTrace(1); !reflect.DeepEqual(x, want1) {
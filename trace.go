@@ -12,6 +12,18 @@ import (
 type Trace struct {
 	Span          // Root span
 	Sub  []*Trace // Children
+
+	// Truncated is set on a root trace when some of it's spans were left
+	// out (see InfluxDBStore.TraceWithOpts).
+	Truncated bool `json:",omitempty"`
+
+	// UnattachedSpans are the subtrees of a root trace which couldn't be
+	// attached to it, because their parent is within their own subtree.
+	UnattachedSpans []*Trace `json:",omitempty"`
+
+	// TraceIDHigh is set on a root trace to the high 64 bits of it's
+	// 128-bit trace ID, if any (see TraceIDHighAnnotationKey).
+	TraceIDHigh ID `json:",omitempty"`
 }
 
 // String returns the Trace as a formatted string.